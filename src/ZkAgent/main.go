@@ -2,51 +2,219 @@ package main
 
 import (
 	za "ZkAgent/server"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const usage = `Usage: zk-agent [command] [flags] [-- child command]
+
+Commands:
+  run              Render targets and keep watching zookeeper (default)
+  render           Render targets and run their commands once, then exit
+                   (same as ` + "`run -once`" + `)
+  exec             Render targets, then run and supervise the child command,
+                   reloading or restarting it on changes (see ` + "`exec`" + ` in the
+                   configuration); exits with the status of the child
+  validate-config  Check the configuration file and print every problem found
+
+Exit status of a one-shot render: 0 when every target was rendered, 1 when a
+pipeline failed, 2 when the configuration is invalid, 3 when zookeeper could
+not be reached within -timeout and no snapshot cache could be used, and 4 when
+every target was rendered, but from the stale snapshot cache.
+
+Flags:
+`
+
+const (
+	exitFailed        = 1
+	exitInvalidConfig = 2
+	exitNoZookeeper   = 3
+	exitStale         = 4
 )
 
 func main() {
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Println(err)
+	command := "run"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("zk-agent", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	configPath := flags.String("config", "config.json", "Location of configuration file (.json, .yaml, .yml or .toml)")
+	once := flags.Bool("once", false, "Render targets and run their commands once, then exit")
+	dryRun := flags.Bool("dry-run", false, "Log the diff of the files that would be written and the commands that would run, without touching anything")
+	timeout := flags.Duration("timeout", 30*time.Second, "How long a one-shot render waits for zookeeper")
+	logLevel := flags.String("log-level", "info", "Lowest level logged: debug, info, warn or error")
+	logFormat := flags.String("log-format", za.LogFormatLogfmt, "Log format: logfmt or json")
+	flags.Parse(args)
+
+	level, err := za.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger, err := za.NewLogger(os.Stdout, *logFormat, level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	options := []za.Option{za.WithLogger(logger)}
+	if *dryRun {
+		options = append(options, za.WithDryRun())
+	}
+	switch command {
+	case "run":
+		if *once {
+			os.Exit(renderOnce(logger, *configPath, *timeout, options))
+		}
+		os.Exit(run(logger, *configPath, options))
+	case "render":
+		os.Exit(renderOnce(logger, *configPath, *timeout, options))
+	case "exec":
+		os.Exit(execChild(logger, *configPath, flags.Args(), options))
+	case "validate-config":
+		os.Exit(validateConfig(*configPath))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command `%s`.\n", command)
+		flags.Usage()
+		os.Exit(2)
+	}
+}
+
+func run(logger za.Logger, configPath string, options []za.Option) int {
+	logger.Log(za.LevelInfo, "Welcome to zk-agent.", "config", configPath)
+	config, err := za.LoadConfig(configPath)
+	if err != nil {
+		logger.Log(za.LevelError, "Load configuration failed.", "error", err)
+		return 1
+	}
+	agent, err := za.New(*config, options...)
+	if err != nil {
+		logger.Log(za.LevelError, "Create agent failed.", "error", err)
+		return 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		agent.Stop()
+	}()
+	go func() {
+		for event := range agent.Events() {
+			logEvent(logger, event)
 		}
 	}()
-	fmt.Println("Welcome to zk-agent.")
-	configPath := flag.String("config", "", "Location of configuration file")
-	// FOR Debug begin
-	debugPath := "config.json"
-	configPath = &debugPath
-	// FOR Debug end
+	if err := agent.Run(ctx); err != nil {
+		logger.Log(za.LevelError, "Agent stopped.", "error", err)
+		return 1
+	}
+	logger.Log(za.LevelInfo, "zk-agent shutdown.")
+	return 0
+}
 
-	config, err := parseConfig(*configPath)
+func renderOnce(logger za.Logger, configPath string, timeout time.Duration, options []za.Option) int {
+	config, err := za.LoadConfig(configPath)
 	if err != nil {
-		panic(err)
+		logger.Log(za.LevelError, "Load configuration failed.", "error", err)
+		return exitInvalidConfig
 	}
-	ec, err := za.ZkAgentStart(config)
+	agent, err := za.New(*config, options...)
 	if err != nil {
-		panic(err)
+		logger.Log(za.LevelError, "Create agent failed.", "error", err)
+		return exitInvalidConfig
 	}
-	for {
-		event, isAlive := <-ec
-		fmt.Println(event)
-		if !isAlive {
-			fmt.Println("zk-agent shutdown.")
-			return
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan struct{})
+	stale := false
+	go func() {
+		for event := range agent.Events() {
+			logEvent(logger, event)
+			stale = stale || event.Stale
 		}
+		close(done)
+	}()
+	err = agent.RenderOnce(ctx)
+	<-done
+	switch {
+	case err == za.ErrNoSession:
+		logger.Log(za.LevelError, "Render failed.", "error", err)
+		return exitNoZookeeper
+	case err != nil:
+		logger.Log(za.LevelError, "Render failed.", "error", err)
+		return exitFailed
+	case stale:
+		logger.Log(za.LevelWarn, "Rendered from the stale snapshot cache.")
+		return exitStale
 	}
+	return 0
 }
 
-func parseConfig(configPath string) (map[string]interface{}, error) {
-	data, err := ioutil.ReadFile(configPath)
+func execChild(logger za.Logger, configPath string, command []string, options []za.Option) int {
+	config, err := za.LoadConfig(configPath)
+	if err != nil {
+		logger.Log(za.LevelError, "Load configuration failed.", "error", err)
+		return 1
+	}
+	execConfig := za.ExecConfig{}
+	if config.Exec != nil {
+		execConfig = *config.Exec
+	}
+	if len(command) > 0 {
+		// already split by the shell which started us
+		execConfig.Command = za.CommandConfig{Argv: command}
+	}
+	agent, err := za.New(*config, options...)
 	if err != nil {
-		return nil, err
+		logger.Log(za.LevelError, "Create agent failed.", "error", err)
+		return 1
 	}
-	var jsonObj map[string]interface{}
-	if err := json.Unmarshal([]byte(data), &jsonObj); err != nil {
-		return nil, err
+	supervisor, err := za.NewSupervisor(agent, execConfig)
+	if err != nil {
+		logger.Log(za.LevelError, "Create supervisor failed.", "error", err)
+		return 1
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, za.ForwardSignals...)
+	code, err := supervisor.Run(context.Background(), signals, func(event *za.AgentEvent) {
+		logEvent(logger, event)
+	})
+	if err != nil {
+		logger.Log(za.LevelError, "Supervisor stopped.", "error", err)
+	}
+	return code
+}
+
+// logEvent logs event at error level when it failed, at debug level when
+// nothing changed.
+func logEvent(logger za.Logger, event *za.AgentEvent) {
+	level := za.LevelInfo
+	switch {
+	case event.Err != nil:
+		level = za.LevelError
+	case event.Type == za.EventUnchanged:
+		level = za.LevelDebug
+	}
+	logger.Log(level, event.Type.String(), event.Fields()...)
+}
+
+func validateConfig(configPath string) int {
+	_, err := za.LoadConfig(configPath)
+	if err != nil {
+		fmt.Println(err)
+		return 1
 	}
-	return jsonObj, nil
+	fmt.Printf("Configuration `%s` is valid.\n", configPath)
+	return 0
 }
@@ -0,0 +1,317 @@
+package ZkAgent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const adminShutdownTimeout = 5 * time.Second
+
+// reloadRequest asks the event loop to reload a unit, see POST /v1/reload.
+type reloadRequest struct {
+	unit  *reloadUnit
+	force bool
+	reply chan *AgentEvent
+}
+
+// listenAdmin listens on address, a TCP address or `unix:` followed by the
+// path of a unix socket.
+func listenAdmin(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		socketPath := strings.TrimPrefix(address, "unix:")
+		// a socket left over by a previous run would fail the listen, any
+		// other file is left alone
+		if info, err := os.Lstat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(socketPath)
+		}
+		return net.Listen("unix", socketPath)
+	}
+	return net.Listen("tcp", address)
+}
+
+// serveAdmin serves the admin API on address until the returned stop
+// function is called.
+func (self *Agent) serveAdmin(address string) (func(), error) {
+	listener, err := listenAdmin(address)
+	if err != nil {
+		return nil, fmt.Errorf("Listen admin API on `%s` failed, cause by: %+v", address, err)
+	}
+	server := &http.Server{Handler: self.AdminHandler()}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			self.logger.Log(LevelError, "Admin API stopped.", "error", err)
+		}
+	}()
+	self.logger.Log(LevelInfo, "Admin API listening.", "address", address)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
+
+// AdminHandler returns the handler of the admin API:
+//
+//	GET  /health                 zookeeper state and last successful render
+//	                             of every pipeline; 503 until all rendered
+//	GET  /v1/snapshot?prefix=P   the watched nodes, under P if given
+//	GET  /v1/pipelines           the status of every pipeline and group
+//	GET  /v1/render/NAME         the output of a pipeline or group, with the
+//	                             diff against the files, without writing them
+//	POST /v1/reload/NAME?force=1 reload a pipeline or group now, a member
+//	                             pipeline with its whole group; force writes
+//	                             the targets and runs the command even when
+//	                             unchanged
+//	GET  /metrics                the metrics, in the Prometheus text format
+func (self *Agent) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", self.handleHealth)
+	mux.HandleFunc("/v1/snapshot", self.handleSnapshot)
+	mux.HandleFunc("/v1/pipelines", self.handlePipelines)
+	mux.HandleFunc("/v1/render/", self.handleRender)
+	mux.HandleFunc("/v1/reload/", self.handleReload)
+	mux.HandleFunc("/metrics", self.handleMetrics)
+	return mux
+}
+
+func (self *Agent) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	self.lock.Lock()
+	conn := self.conn
+	self.lock.Unlock()
+	state, sessionID := zk.StateDisconnected, int64(0)
+	if conn != nil {
+		state, sessionID = conn.State(), conn.SessionID()
+	}
+	healthy := state == zk.StateHasSession
+	renders := make(map[string]*time.Time)
+	for _, status := range self.Status() {
+		if status.LastSuccess.IsZero() {
+			healthy = false
+			renders[status.Name] = nil
+			continue
+		}
+		lastSuccess := status.LastSuccess
+		renders[status.Name] = &lastSuccess
+	}
+	code := http.StatusOK
+	if !healthy {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]interface{}{
+		"healthy":     healthy,
+		"stale":       self.isStale(),
+		"state":       state.String(),
+		"sessionId":   sessionID,
+		"lastSuccess": renders,
+	})
+}
+
+func (self *Agent) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	snapshot := self.Snapshot()
+	if prefix := r.URL.Query().Get("prefix"); len(prefix) > 0 {
+		filtered := make(Snapshot)
+		for nodePath, node := range snapshot {
+			if isUnderRoot(nodePath, prefix) {
+				filtered[nodePath] = node
+			}
+		}
+		snapshot = filtered
+	}
+	if snapshot == nil {
+		snapshot = Snapshot{}
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+func (self *Agent) handlePipelines(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, self.Status())
+}
+
+// previewFile is a file rendered by GET /v1/render.
+type previewFile struct {
+	Target  string `json:"target"`
+	Remove  bool   `json:"remove,omitempty"`
+	Changed bool   `json:"changed"`
+	Content string `json:"content,omitempty"`
+	Diff    string `json:"diff,omitempty"`
+}
+
+func (self *Agent) handleRender(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/v1/render/")
+	pipelines := self.findPipelines(name)
+	if pipelines == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no pipeline or group `%s`", name))
+		return
+	}
+	if self.Snapshot() == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("not connected to zookeeper yet"))
+		return
+	}
+	files, err := self.preview(pipelines)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "files": files})
+}
+
+// preview renders pipelines like reload does, without writing anything.
+func (self *Agent) preview(pipelines []*Pipeline) ([]previewFile, error) {
+	raw := self.Snapshot()
+	files := []previewFile{}
+	for _, pipeline := range pipelines {
+		outputs, removals, err := self.render(pipeline, self.decode(pipeline, raw))
+		if err != nil {
+			return nil, fmt.Errorf("pipeline `%s`: %v", pipeline.Name, err)
+		}
+		changes, err := planChanges(outputs, removals, false, pipeline.File)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline `%s`: %v", pipeline.Name, err)
+		}
+		for _, change := range changes {
+			from, to := change.target, change.target+" (rendered)"
+			if !change.existed {
+				from = ""
+			}
+			if change.remove {
+				to = ""
+			}
+			files = append(files, previewFile{
+				Target:  change.target,
+				Remove:  change.remove,
+				Changed: !change.unchanged,
+				Content: string(change.data),
+				Diff:    unifiedDiff(from, to, change.previous, change.data),
+			})
+		}
+	}
+	return files, nil
+}
+
+func (self *Agent) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/v1/reload/")
+	unit := self.findUnit(name)
+	if unit == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no pipeline or group `%s`", name))
+		return
+	}
+	force := r.URL.Query().Get("force")
+	req := reloadRequest{
+		unit:  unit,
+		force: force == "1" || force == "true",
+		reply: make(chan *AgentEvent, 1),
+	}
+	select {
+	case self.reloads <- req:
+	case <-self.done:
+		writeError(w, http.StatusServiceUnavailable, errors.New("agent is not running"))
+		return
+	case <-r.Context().Done():
+		return
+	}
+	event := <-req.reply
+	code := http.StatusOK
+	if event.Err != nil {
+		code = http.StatusInternalServerError
+	}
+	writeJSON(w, code, eventJSON(event))
+}
+
+// findPipelines returns the pipelines of the unit called name, or the
+// member pipeline called name, or nil.
+func (self *Agent) findPipelines(name string) []*Pipeline {
+	for _, unit := range self.units {
+		if unit.name == name {
+			return unit.pipelines
+		}
+	}
+	for _, pipeline := range self.pipelines {
+		if pipeline.Name == name {
+			return []*Pipeline{pipeline}
+		}
+	}
+	return nil
+}
+
+// findUnit returns the unit called name, or the unit of the member pipeline
+// called name, which is reloaded with its whole group, or nil.
+func (self *Agent) findUnit(name string) *reloadUnit {
+	for _, unit := range self.units {
+		if unit.name == name {
+			return unit
+		}
+	}
+	for _, unit := range self.units {
+		for _, pipeline := range unit.pipelines {
+			if pipeline.Name == name {
+				return unit
+			}
+		}
+	}
+	return nil
+}
+
+// eventJSON is the JSON form of an event, whose error does not marshal.
+func eventJSON(event *AgentEvent) map[string]interface{} {
+	res := map[string]interface{}{
+		"type":     event.Type.String(),
+		"time":     event.Time,
+		"group":    event.Group,
+		"pipeline": event.Pipeline,
+		"files":    event.Files,
+		"hash":     event.Hash,
+		"command":  event.Command,
+		"stdout":   event.Stdout,
+		"stderr":   event.Stderr,
+		"exitCode": event.ExitCode,
+	}
+	if event.Err != nil {
+		res["error"] = event.Err.Error()
+	}
+	return res
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(body)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
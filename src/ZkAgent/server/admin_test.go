@@ -0,0 +1,188 @@
+package ZkAgent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newAdminAgent(t *testing.T) (*Agent, *fakeRunner, string) {
+	dir := t.TempDir()
+	tmpl := writeFile(t, dir, "app.tmpl", `{{ range children "/app" }}{{ .Path }}={{ .Value }}
+{{ end }}`)
+	target := filepath.Join(dir, "app.conf")
+	runner := &fakeRunner{}
+	config := Config{
+		ZkServer: StringList{"127.0.0.1:2181"},
+		StateDir: dir,
+		Pipelines: []PipelineConfig{{
+			Name:         "app",
+			ZkDataPath:   StringList{"/app"},
+			Template:     tmpl,
+			Target:       target,
+			ShellCommand: CommandConfig{Shell: "reload app"},
+		}},
+	}
+	return newTestAgent(t, config, runner, testSnapshot()), runner, target
+}
+
+// serveReloads applies the reload requests like the event loop does.
+func serveReloads(agent *Agent) {
+	go func() {
+		for {
+			select {
+			case req := <-agent.reloads:
+				event := agent.reload(req.unit, nil, true, req.force)
+				agent.emit(event)
+				req.reply <- event
+			case <-agent.done:
+				return
+			}
+		}
+	}()
+}
+
+func request(t *testing.T, handler http.Handler, method string, url string, body interface{}) int {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, url, nil))
+	if body != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), body); err != nil {
+			t.Fatalf("%s %s: %v in %q", method, url, err, recorder.Body.String())
+		}
+	}
+	return recorder.Code
+}
+
+func TestAdminHealth(t *testing.T) {
+	agent, _, _ := newAdminAgent(t)
+	var health struct {
+		Healthy     bool
+		State       string
+		LastSuccess map[string]interface{}
+	}
+	if code := request(t, agent.AdminHandler(), "GET", "/health", &health); code != http.StatusServiceUnavailable {
+		t.Errorf("code = %d, want 503 without session", code)
+	}
+	if health.Healthy || health.LastSuccess["app"] != nil {
+		t.Errorf("health = %+v, want unhealthy and no success", health)
+	}
+	if code := request(t, agent.AdminHandler(), "POST", "/health", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST code = %d, want 405", code)
+	}
+}
+
+func TestAdminSnapshot(t *testing.T) {
+	agent, _, _ := newAdminAgent(t)
+	var snapshot Snapshot
+	if code := request(t, agent.AdminHandler(), "GET", "/v1/snapshot?prefix=/app", &snapshot); code != http.StatusOK {
+		t.Fatalf("code = %d", code)
+	}
+	if len(snapshot) != 3 || snapshot["/app/b"].Value != "2" {
+		t.Errorf("snapshot = %v, want the 3 nodes under /app", snapshot)
+	}
+}
+
+func TestAdminRender(t *testing.T) {
+	agent, runner, target := newAdminAgent(t)
+	var res struct {
+		Files []previewFile
+	}
+	if code := request(t, agent.AdminHandler(), "GET", "/v1/render/app", &res); code != http.StatusOK {
+		t.Fatalf("code = %d", code)
+	}
+	if len(res.Files) != 1 {
+		t.Fatalf("files = %+v, want 1", res.Files)
+	}
+	file := res.Files[0]
+	if file.Target != target || !file.Changed || file.Content != "/app/a=1\n/app/b=2\n" {
+		t.Errorf("file = %+v", file)
+	}
+	if !strings.Contains(file.Diff, "+/app/a=1") {
+		t.Errorf("diff = %q, want the added lines", file.Diff)
+	}
+	if _, err := ioutil.ReadFile(target); err == nil {
+		t.Error("render wrote the target")
+	}
+	if commands := runner.commands(); len(commands) > 0 {
+		t.Errorf("render ran %v", commands)
+	}
+	if code := request(t, agent.AdminHandler(), "GET", "/v1/render/missing", nil); code != http.StatusNotFound {
+		t.Errorf("missing pipeline code = %d, want 404", code)
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	agent, runner, target := newAdminAgent(t)
+	defer close(agent.done)
+	serveReloads(agent)
+	handler := agent.AdminHandler()
+
+	var event map[string]interface{}
+	if code := request(t, handler, "POST", "/v1/reload/app", &event); code != http.StatusOK {
+		t.Fatalf("code = %d, event = %v", code, event)
+	}
+	if event["type"] != "Rendered" {
+		t.Errorf("type = %v, want Rendered", event["type"])
+	}
+	if data, _ := ioutil.ReadFile(target); string(data) != "/app/a=1\n/app/b=2\n" {
+		t.Errorf("target = %q", data)
+	}
+	if commands := runner.commands(); len(commands) != 1 || commands[0] != "reload app" {
+		t.Errorf("commands = %v, want the reload command once", commands)
+	}
+
+	if request(t, handler, "POST", "/v1/reload/app", &event); event["type"] != "Unchanged" {
+		t.Errorf("type = %v, want Unchanged", event["type"])
+	}
+	if request(t, handler, "POST", "/v1/reload/app?force=1", &event); event["type"] != "Rendered" {
+		t.Errorf("forced type = %v, want Rendered", event["type"])
+	}
+	if commands := runner.commands(); len(commands) != 2 {
+		t.Errorf("commands = %v, want a second run on force", commands)
+	}
+
+	var status []PipelineStatus
+	request(t, handler, "GET", "/v1/pipelines", &status)
+	if len(status) != 1 || status[0].LastEvent != "Rendered" || status[0].LastSuccess.IsZero() || len(status[0].Hash) == 0 {
+		t.Errorf("status = %+v", status)
+	}
+	if code := request(t, handler, "GET", "/v1/reload/app", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET code = %d, want 405", code)
+	}
+}
+
+func TestAdminReloadGroupMember(t *testing.T) {
+	dir := t.TempDir()
+	tmpl := writeFile(t, dir, "member.tmpl", `{{ value "/other" }}`)
+	config := Config{
+		ZkServer: StringList{"127.0.0.1:2181"},
+		StateDir: dir,
+		Groups:   []GroupConfig{{Name: "web", ShellCommand: CommandConfig{Shell: "reload web"}}},
+		Pipelines: []PipelineConfig{
+			{Name: "one", Group: "web", ZkDataPath: StringList{"/other"}, Template: tmpl, Target: filepath.Join(dir, "one")},
+			{Name: "two", Group: "web", ZkDataPath: StringList{"/other"}, Template: tmpl, Target: filepath.Join(dir, "two")},
+		},
+	}
+	runner := &fakeRunner{}
+	agent := newTestAgent(t, config, runner, testSnapshot())
+	defer close(agent.done)
+	serveReloads(agent)
+
+	var event map[string]interface{}
+	if code := request(t, agent.AdminHandler(), "POST", "/v1/reload/one", &event); code != http.StatusOK {
+		t.Fatalf("code = %d, event = %v", code, event)
+	}
+	if event["group"] != "web" {
+		t.Errorf("group = %v, want the group of the member", event["group"])
+	}
+	for _, name := range []string{"one", "two"} {
+		if data, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(data) != "x" {
+			t.Errorf("%s = %q, want the whole group rendered", name, data)
+		}
+	}
+}
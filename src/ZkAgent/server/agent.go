@@ -0,0 +1,481 @@
+package ZkAgent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const defaultEventBuffer = 64
+
+// Option customizes an Agent created with New.
+type Option func(*Agent)
+
+// WithLogger replaces the default logger, which prints the entries of level
+// info and above to stdout as logfmt. The messages of the zookeeper client go
+// to the same logger.
+func WithLogger(logger Logger) Option {
+	return func(agent *Agent) {
+		agent.logger = logger
+	}
+}
+
+// WithCommandRunner replaces the default runner, which executes the commands
+// as child processes of the agent.
+func WithCommandRunner(runner CommandRunner) Option {
+	return func(agent *Agent) {
+		agent.runner = runner
+	}
+}
+
+// WithEventBuffer sets the capacity of the Events channel.
+func WithEventBuffer(size int) Option {
+	return func(agent *Agent) {
+		agent.events = make(chan *AgentEvent, size)
+	}
+}
+
+// WithDryRun makes the agent only report what it would write, as a unified
+// diff, and which commands it would run, without touching anything.
+func WithDryRun() Option {
+	return func(agent *Agent) {
+		agent.dryRun = true
+	}
+}
+
+// ErrNoSession is returned by RenderOnce when no zookeeper session could be
+// established before its context was done.
+var ErrNoSession = errors.New("Zookeeper session could not be established.")
+
+// Agent renders the pipelines from the watched zookeeper data.
+type Agent struct {
+	config     Config
+	servers    []string
+	chroot     string
+	pipelines  []*Pipeline
+	units      []*reloadUnit
+	logger     Logger
+	runner     CommandRunner
+	events     chan *AgentEvent
+	debouncers map[*reloadUnit]*debouncer
+	dryRun     bool
+
+	lock    sync.Mutex
+	conn    *zk.Conn
+	zkData  *ZkData
+	running bool
+	// authenticated is set once the auth entries were added to the
+	// connection.
+	authenticated bool
+	// stale is set while the data comes from the snapshot cache.
+	stale bool
+
+	statusLock sync.Mutex
+	status     map[string]*PipelineStatus
+	reloads    chan reloadRequest
+	metrics    *metrics
+
+	// decodeErrors holds, per pipeline, the modification zxid of the nodes
+	// whose decode failure was reported.
+	decodeLock   sync.Mutex
+	decodeErrors map[string]map[string]int64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	ready    chan struct{}
+	done     chan struct{}
+	// changed holds a pending notification that targets were replaced after
+	// the initial render. Unlike events it is never dropped: further changes
+	// fold into the pending one.
+	changed chan struct{}
+}
+
+// New validates config and creates an Agent. Nothing is connected until Run.
+func New(config Config, options ...Option) (*Agent, error) {
+	if errs := config.Validate(); errs != nil {
+		return nil, errs
+	}
+	config.normalize()
+	pipelines, err := buildPipelines(&config)
+	if err != nil {
+		return nil, err
+	}
+	units, err := buildUnits(&config, pipelines)
+	if err != nil {
+		return nil, err
+	}
+	servers, chroot, err := parseServers(config.ZkServer)
+	if err != nil {
+		return nil, err
+	}
+	agent := &Agent{
+		config:     config,
+		servers:    servers,
+		chroot:     chroot,
+		pipelines:  pipelines,
+		units:      units,
+		logger:     &streamLogger{writer: os.Stdout, level: LevelInfo},
+		runner:     execRunner{},
+		events:     make(chan *AgentEvent, defaultEventBuffer),
+		debouncers: make(map[*reloadUnit]*debouncer),
+		status:     make(map[string]*PipelineStatus),
+		reloads:    make(chan reloadRequest),
+		metrics:    newMetrics(),
+		stop:       make(chan struct{}),
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+		changed:    make(chan struct{}, 1),
+	}
+	for _, option := range options {
+		option(agent)
+	}
+	return agent, nil
+}
+
+// Events returns the stream of agent events. It is closed when Run returns.
+// Events are dropped, and logged, while the channel is full.
+func (self *Agent) Events() <-chan *AgentEvent {
+	return self.events
+}
+
+// Ready is closed once Run rendered every pipeline and started watching for
+// changes.
+func (self *Agent) Ready() <-chan struct{} {
+	return self.ready
+}
+
+// Snapshot returns the current zookeeper data, or nil before Run connected.
+func (self *Agent) Snapshot() Snapshot {
+	self.lock.Lock()
+	zkData := self.zkData
+	self.lock.Unlock()
+	if zkData == nil {
+		return nil
+	}
+	return zkData.Snapshot()
+}
+
+// Stop makes Run return. It can be called several times and from any
+// goroutine.
+func (self *Agent) Stop() {
+	self.stopOnce.Do(func() {
+		close(self.stop)
+	})
+}
+
+// Run connects to zookeeper, renders every pipeline and keeps reloading them
+// on changes until ctx is done or Stop is called. An Agent can only run once.
+func (self *Agent) Run(ctx context.Context) error {
+	return self.run(ctx, false)
+}
+
+// RenderOnce connects to zookeeper, renders every pipeline and runs its
+// command, then returns. It returns ErrNoSession when ctx is done before
+// zookeeper could be reached, or an error naming the pipelines and groups
+// which failed. An Agent can only run once.
+func (self *Agent) RenderOnce(ctx context.Context) error {
+	return self.run(ctx, true)
+}
+
+func (self *Agent) run(ctx context.Context, once bool) error {
+	self.lock.Lock()
+	if self.running {
+		self.lock.Unlock()
+		return errors.New("Agent is already running.")
+	}
+	self.running = true
+	self.lock.Unlock()
+	defer close(self.events)
+	defer close(self.done)
+
+	if admin := self.config.Admin; admin != nil && !once {
+		stopAdmin, err := self.serveAdmin(admin.Listen)
+		if err != nil {
+			return err
+		}
+		defer stopAdmin()
+	}
+
+	// setup connection
+	conn, zkEvents, err := zk.Connect(self.servers, time.Duration(self.config.SessionTimeout), func(conn *zk.Conn) {
+		// set before the connection loop starts, which logs from then on
+		conn.SetLogger(zkLogger{self.logger})
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	eventChan := self.queueEvents(zkEvents)
+
+	// get and watch data of every pipeline root
+	zkData, err := self.syncData(ctx, conn, eventChan, once)
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	self.conn, self.zkData = conn, zkData
+	self.lock.Unlock()
+
+	// Generate target files
+	var failed []string
+	for _, unit := range self.units {
+		event := self.reload(unit, nil, once, false)
+		event.Initial = true
+		self.emit(event)
+		if event.Err == nil {
+			continue
+		}
+		if !once {
+			return fmt.Errorf("Render `%s` failed, cause by: %+v", unit.name, event.Err)
+		}
+		failed = append(failed, unit.name)
+	}
+	if once {
+		if len(failed) > 0 {
+			return fmt.Errorf("Render `%s` failed.", strings.Join(failed, "`, `"))
+		}
+		return nil
+	}
+
+	close(self.ready)
+
+	// Keep Listening
+	return self.loop(ctx, eventChan)
+}
+
+// syncData fetches and watches the data of every pipeline root. When a cache
+// is configured and zookeeper cannot be reached in time, the data is loaded
+// from the cache instead, and stays stale until a session is established and
+// the loop reconciles it.
+func (self *Agent) syncData(ctx context.Context, conn *zk.Conn, eventChan <-chan zk.Event, once bool) (*ZkData, error) {
+	roots := collectRoots(self.pipelines)
+	if cache := self.config.Cache; once || cache != nil {
+		waitCtx := ctx
+		if !once {
+			var cancel context.CancelFunc
+			waitCtx, cancel = context.WithTimeout(ctx, time.Duration(cache.Timeout))
+			defer cancel()
+		}
+		err := self.waitSession(waitCtx, eventChan)
+		if err != nil {
+			if cache == nil || self.stopping() || (!once && ctx.Err() != nil) {
+				return nil, err
+			}
+			zkData, cerr := self.loadCache(conn, roots)
+			if cerr == nil {
+				self.setStale(true)
+				return zkData, nil
+			}
+			self.logger.Log(LevelError, "Load snapshot cache failed.", "error", cerr)
+			if once {
+				return nil, err
+			}
+			// nothing to render meanwhile, keep waiting for zookeeper
+			if err := self.waitSession(ctx, eventChan); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := self.authenticate(conn); err != nil {
+		return nil, err
+	}
+	zkData := self.newZkData(conn, roots)
+	if err := zkData.watchRoots(); err != nil {
+		return nil, err
+	}
+	self.saveCache(zkData)
+	return zkData, nil
+}
+
+// newZkData returns an empty ZkData of roots set up after the configuration.
+func (self *Agent) newZkData(conn *zk.Conn, roots []string) *ZkData {
+	zkData := NewZkData(roots, conn)
+	zkData.Chroot = self.chroot
+	zkData.SkipNoAuth = self.config.NoAuthPolicy == NoAuthSkip
+	zkData.OnSkip = func(nodePath string, err error) {
+		self.logger.Log(LevelWarn, "Node not readable, skipped.", "path", nodePath, "error", err)
+	}
+	return zkData
+}
+
+func (self *Agent) stopping() bool {
+	select {
+	case <-self.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// queueEvents reads the events of the zookeeper client as soon as they are
+// delivered and queues them, without bound, until the agent takes them. The
+// client drops the events its small buffer cannot hold, and a dropped watch
+// event is never followed by another one, while the agent may be busy with a
+// command for a long time. The returned channel is closed after the events of
+// the closed connection were taken, or when Run returns.
+func (self *Agent) queueEvents(in <-chan zk.Event) <-chan zk.Event {
+	out := make(chan zk.Event)
+	go func() {
+		defer close(out)
+		var queue []zk.Event
+		for in != nil || len(queue) > 0 {
+			var send chan zk.Event
+			var next zk.Event
+			if len(queue) > 0 {
+				send, next = out, queue[0]
+			}
+			select {
+			case event, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				queue = append(queue, event)
+			case send <- next:
+				queue = queue[1:]
+			case <-self.done:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// waitSession waits until the connection has a session, so that a missing
+// zookeeper does not block the requests forever.
+func (self *Agent) waitSession(ctx context.Context, eventChan <-chan zk.Event) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ErrNoSession
+		case <-self.stop:
+			return ErrNoSession
+		case event, ok := <-eventChan:
+			if !ok {
+				return errors.New("Zookeeper connection closed.")
+			}
+			self.metrics.observeZkEvent(event)
+			if event.State == zk.StateHasSession {
+				return nil
+			}
+		}
+	}
+}
+
+func (self *Agent) loop(ctx context.Context, eventChan <-chan zk.Event) error {
+	dueChan := make(chan dueReload)
+	done := make(chan struct{})
+	tracker := newSessionTracker(self.conn)
+	if self.isStale() {
+		// the cached data must be reconciled on the first session
+		tracker.disconnected = true
+	}
+	for _, unit := range self.units {
+		self.debouncers[unit] = newDebouncer(unit, dueChan, done)
+	}
+	defer func() {
+		close(done)
+		for _, d := range self.debouncers {
+			d.stop()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-self.stop:
+			return nil
+		case due := <-dueChan:
+			self.emit(self.reload(due.unit, due.paths, true, false))
+		case req := <-self.reloads:
+			event := self.reload(req.unit, nil, true, req.force)
+			self.emit(event)
+			req.reply <- event
+		case event, ok := <-eventChan:
+			if !ok {
+				return errors.New("Zookeeper connection closed.")
+			}
+			self.metrics.observeZkEvent(event)
+			switch event.Type {
+			case zk.EventNodeDataChanged, zk.EventNodeChildrenChanged, zk.EventNodeCreated, zk.EventNodeDeleted:
+				nodePath, ok := self.zkData.LocalPath(event.Path)
+				if !ok {
+					self.logger.Log(LevelWarn, "Event outside of the chroot.", "event", event.Type, "path", event.Path)
+					continue
+				}
+				self.logger.Log(LevelDebug, "Node changed.", "event", event.Type, "path", nodePath)
+				self.reloadAll(nodePath)
+			case zk.EventSession:
+				self.logger.Log(LevelInfo, "Session state changed.", "event", event.Type, "state", event.State, "server", event.Server, "session", fmt.Sprintf("0x%x", self.conn.SessionID()))
+				self.handleSession(tracker, event)
+			default:
+				self.logger.Log(LevelWarn, "Unexpected zookeeper event.", "event", event.Type, "state", event.State, "path", event.Path, "error", event.Err)
+			}
+		}
+	}
+}
+
+func (self *Agent) handleSession(tracker *sessionTracker, event zk.Event) {
+	switch event.State {
+	case zk.StateDisconnected:
+		self.emit(&AgentEvent{Type: EventDisconnected, Time: time.Now()})
+	case zk.StateExpired:
+		self.emit(&AgentEvent{Type: EventDisconnected, Time: time.Now(), Err: zk.ErrSessionExpired})
+	}
+	if tracker.update(event) {
+		if err := self.authenticate(self.conn); err != nil {
+			self.emit(&AgentEvent{Type: EventReconnected, Time: time.Now(), Err: err})
+			return
+		}
+		changed, err := self.zkData.Resync()
+		if err == nil {
+			if self.isStale() {
+				self.setStale(false)
+				self.logger.Log(LevelInfo, "Snapshot cache reconciled with zookeeper.", "changed", len(changed))
+			}
+			self.saveCache(self.zkData)
+		}
+		self.emit(&AgentEvent{Type: EventReconnected, Time: time.Now(), Paths: changed, Err: err})
+		self.dispatch(changed)
+	}
+}
+
+func (self *Agent) emit(event *AgentEvent) {
+	if len(event.source()) > 0 && self.isStale() {
+		event.Stale = true
+	}
+	self.recordStatus(event)
+	self.metrics.observeEvent(event)
+	if event.Type == EventRendered && !event.Initial && !event.DryRun {
+		select {
+		case self.changed <- struct{}{}:
+		default:
+		}
+	}
+	select {
+	case self.events <- event:
+	default:
+		self.logger.Log(LevelWarn, "Event buffer full, event dropped.", "event", event.Type, "pipeline", event.source())
+	}
+}
+
+// collectRoots returns the distinct roots of all pipelines, in declaration order.
+func collectRoots(pipelines []*Pipeline) []string {
+	seen := make(map[string]bool)
+	roots := make([]string, 0, len(pipelines))
+	for _, pipeline := range pipelines {
+		for _, root := range pipeline.Roots {
+			if !seen[root] {
+				seen[root] = true
+				roots = append(roots, root)
+			}
+		}
+	}
+	return roots
+}
@@ -0,0 +1,171 @@
+package ZkAgent
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// fakeRunner records the invocations instead of running them, and returns
+// result and err for each.
+type fakeRunner struct {
+	mu          sync.Mutex
+	invocations []*Invocation
+	result      CommandResult
+	err         error
+}
+
+func (self *fakeRunner) Run(invocation *Invocation) (*CommandResult, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.invocations = append(self.invocations, invocation)
+	result := self.result
+	return &result, self.err
+}
+
+func (self *fakeRunner) commands() []string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	var res []string
+	for _, invocation := range self.invocations {
+		res = append(res, invocation.String())
+	}
+	return res
+}
+
+// fakeZk serves the reads of ZkData from a map of nodes, without watches.
+type fakeZk map[string]fakeZkNode
+
+type fakeZkNode struct {
+	value    string
+	version  int32
+	children []string
+}
+
+func (self fakeZk) stat(node fakeZkNode) *zk.Stat {
+	return &zk.Stat{Version: node.version, Cversion: int32(len(node.children)), NumChildren: int32(len(node.children))}
+}
+
+func (self fakeZk) ChildrenW(nodePath string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	node, ok := self[nodePath]
+	if !ok {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	return node.children, self.stat(node), nil, nil
+}
+
+func (self fakeZk) GetW(nodePath string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	node, ok := self[nodePath]
+	if !ok {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	return []byte(node.value), self.stat(node), nil, nil
+}
+
+func (self fakeZk) ExistsW(nodePath string) (bool, *zk.Stat, <-chan zk.Event, error) {
+	node, ok := self[nodePath]
+	if !ok {
+		return false, nil, nil, nil
+	}
+	return true, self.stat(node), nil, nil
+}
+
+// writeFile writes content to name in dir and returns its path.
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+	filePath := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+// newTestAgent creates an agent of config which logs nowhere and runs its
+// commands with runner, holding data as if it had been read from zookeeper.
+func newTestAgent(t *testing.T, config Config, runner CommandRunner, data Snapshot) *Agent {
+	t.Helper()
+	logger, err := NewLogger(ioutil.Discard, LogFormatLogfmt, LevelDebug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent, err := New(config, WithLogger(logger), WithCommandRunner(runner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zkData := NewZkData(collectRoots(agent.pipelines), nil)
+	zkData.snapshot = data
+	agent.zkData = zkData
+	return agent
+}
+
+func validConfig() Config {
+	return Config{
+		ZkServer: StringList{"127.0.0.1:2181"},
+		Pipelines: []PipelineConfig{{
+			Name:       "app",
+			ZkDataPath: StringList{"/app"},
+			Template:   "app.tmpl",
+			Target:     "app.conf",
+		}},
+	}
+}
+
+func testSnapshot() Snapshot {
+	return Snapshot{
+		"/app":   ZkNode{Path: "/app", Childs: []string{"a", "b"}},
+		"/app/a": ZkNode{Path: "/app/a", Value: "1"},
+		"/app/b": ZkNode{Path: "/app/b", Value: "2"},
+		"/other": ZkNode{Path: "/other", Value: "x"},
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	runner := &fakeRunner{}
+	logger, _ := NewLogger(ioutil.Discard, LogFormatJSON, LevelWarn)
+	agent, err := New(validConfig(), WithLogger(logger), WithCommandRunner(runner), WithEventBuffer(3), WithDryRun())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.logger != logger || agent.runner != runner || cap(agent.events) != 3 || !agent.dryRun {
+		t.Errorf("options not applied: %+v", agent)
+	}
+	config := validConfig()
+	config.ZkServer = nil
+	if _, err := New(config); err == nil {
+		t.Error("New accepted an invalid configuration")
+	} else if _, ok := err.(ConfigErrors); !ok {
+		t.Errorf("error %T, want ConfigErrors", err)
+	}
+}
+
+func TestRunStops(t *testing.T) {
+	config := validConfig()
+	config.ZkServer = StringList{"127.0.0.1:1"}
+	logger, _ := NewLogger(ioutil.Discard, LogFormatLogfmt, LevelDebug)
+	agent, err := New(config, WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- agent.Run(ctx)
+	}()
+	agent.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+	for range agent.Events() {
+	}
+	if agent.Snapshot() != nil {
+		t.Error("snapshot without a session")
+	}
+}
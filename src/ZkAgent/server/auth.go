@@ -0,0 +1,96 @@
+package ZkAgent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const (
+	defaultAuthScheme = "digest"
+
+	// NoAuthFail fails the sync when a node cannot be read for lack of
+	// permission, NoAuthSkip leaves the node out.
+	NoAuthFail = "fail"
+	NoAuthSkip = "skip"
+)
+
+// parseServers splits the zookeeper connection string, in the standard
+// `host1:2181,host2:2181/chroot` form, into servers and chroot. The entries
+// of zkServer are joined first, so the servers can also be listed one by
+// one, the chroot following the last of them.
+func parseServers(entries []string) ([]string, string, error) {
+	connectString := strings.Join(entries, ",")
+	chroot := ""
+	if i := strings.IndexByte(connectString, '/'); i >= 0 {
+		connectString, chroot = connectString[:i], connectString[i:]
+	}
+	var servers []string
+	for _, server := range strings.Split(connectString, ",") {
+		if server = strings.TrimSpace(server); len(server) > 0 {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		return nil, "", errors.New("at least one server is required")
+	}
+	if strings.ContainsRune(chroot, ',') {
+		return nil, "", fmt.Errorf("chroot `%s` must follow the last server", chroot)
+	}
+	if chroot == "/" {
+		chroot = ""
+	}
+	if len(chroot) > 0 && path.Clean(chroot) != chroot {
+		return nil, "", fmt.Errorf("invalid chroot `%s`", chroot)
+	}
+	return servers, chroot, nil
+}
+
+// credentials returns the credentials of the entry, read from the file or
+// the environment variable when configured so.
+func (self *AuthConfig) credentials() ([]byte, error) {
+	switch {
+	case len(self.CredentialsFile) > 0:
+		data, err := ioutil.ReadFile(self.CredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("Read credentials file `%s` failed, cause by: %+v", self.CredentialsFile, err)
+		}
+		return []byte(strings.TrimRight(string(data), "\r\n")), nil
+	case len(self.CredentialsEnv) > 0:
+		value, ok := os.LookupEnv(self.CredentialsEnv)
+		if !ok {
+			return nil, fmt.Errorf("Environment variable `%s` of the credentials is not set.", self.CredentialsEnv)
+		}
+		return []byte(value), nil
+	}
+	return []byte(self.Credentials), nil
+}
+
+// authenticate adds the auth entries of the configuration to the connection,
+// once it has a session. The client re-submits them by itself after every
+// reconnect, new sessions included.
+func (self *Agent) authenticate(conn *zk.Conn) error {
+	if self.authenticated {
+		return nil
+	}
+	for i := range self.config.Auth {
+		auth := &self.config.Auth[i]
+		credentials, err := auth.credentials()
+		if err != nil {
+			return err
+		}
+		if err := conn.AddAuth(auth.Scheme, credentials); err != nil {
+			return fmt.Errorf("Add `%s` auth failed, cause by: %+v", auth.Scheme, err)
+		}
+	}
+	if len(self.config.Auth) > 0 {
+		self.logger.Log(LevelInfo, "Authenticated to zookeeper.", "auth", len(self.config.Auth), "session", fmt.Sprintf("0x%x", conn.SessionID()))
+	}
+	self.authenticated = true
+	return nil
+}
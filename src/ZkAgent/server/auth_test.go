@@ -0,0 +1,36 @@
+package ZkAgent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseServers(t *testing.T) {
+	tests := []struct {
+		entries []string
+		servers []string
+		chroot  string
+		err     bool
+	}{
+		{entries: []string{"h1:2181"}, servers: []string{"h1:2181"}},
+		{entries: []string{"h1:2181, h2:2181,"}, servers: []string{"h1:2181", "h2:2181"}},
+		{entries: []string{"h1:2181,h2:2181/app/conf"}, servers: []string{"h1:2181", "h2:2181"}, chroot: "/app/conf"},
+		{entries: []string{"h1:2181", "h2:2181/app"}, servers: []string{"h1:2181", "h2:2181"}, chroot: "/app"},
+		{entries: []string{"h1:2181/"}, servers: []string{"h1:2181"}},
+		{entries: []string{"h1:2181/app", "h2:2181"}, err: true},
+		{entries: []string{"h1:2181/app/"}, err: true},
+		{entries: []string{"h1:2181/app//conf"}, err: true},
+		{entries: []string{"/app"}, err: true},
+		{entries: nil, err: true},
+	}
+	for _, test := range tests {
+		servers, chroot, err := parseServers(test.entries)
+		if (err != nil) != test.err {
+			t.Errorf("%q: error %v", test.entries, err)
+			continue
+		}
+		if !reflect.DeepEqual(servers, test.servers) || chroot != test.chroot {
+			t.Errorf("%q: servers %q chroot %q, want %q %q", test.entries, servers, chroot, test.servers, test.chroot)
+		}
+	}
+}
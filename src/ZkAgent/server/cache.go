@@ -0,0 +1,107 @@
+package ZkAgent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const (
+	cacheVersion = 1
+	// defaultCacheTimeout is how long the agent waits for zookeeper at
+	// startup before rendering from the cache.
+	defaultCacheTimeout = 10 * time.Second
+)
+
+// cacheFile is the content of the snapshot cache. The nodes keep their stat,
+// zxids included.
+type cacheFile struct {
+	Version int       `json:"version"`
+	SavedAt time.Time `json:"savedAt"`
+	Roots   []string  `json:"roots"`
+	Nodes   Snapshot  `json:"nodes"`
+}
+
+// saveCache persists the data of zkData to the cache file, if one is
+// configured. It is called after every successful sync.
+func (self *Agent) saveCache(zkData *ZkData) {
+	cache := self.config.Cache
+	if cache == nil || self.dryRun {
+		return
+	}
+	data, err := json.Marshal(cacheFile{
+		Version: cacheVersion,
+		SavedAt: time.Now(),
+		Roots:   zkData.Roots,
+		Nodes:   zkData.Snapshot(),
+	})
+	if err == nil {
+		// the nodes may hold credentials
+		err = writeFileAtomic(cache.Path, data, FileOptions{Mode: 0600, Uid: -1, Gid: -1})
+	}
+	if err != nil {
+		self.logger.Log(LevelError, "Save snapshot cache failed.", "cache", cache.Path, "error", err)
+	}
+}
+
+// loadCache returns a ZkData holding the nodes of the cache file under
+// roots. It sets no watch: the data is reconciled by Resync once a session
+// is established.
+func (self *Agent) loadCache(conn *zk.Conn, roots []string) (*ZkData, error) {
+	cachePath := self.config.Cache.Path
+	data, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		return nil, fmt.Errorf("Read snapshot cache `%s` failed, cause by: %+v", cachePath, err)
+	}
+	var cache cacheFile
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, fmt.Errorf("Parse snapshot cache `%s` failed, cause by: %+v", cachePath, err)
+	}
+	if cache.Version != cacheVersion {
+		return nil, fmt.Errorf("Unsupported snapshot cache `%s` version %d.", cachePath, cache.Version)
+	}
+	nodes := make(Snapshot)
+	for nodePath, node := range cache.Nodes {
+		for _, root := range roots {
+			if isUnderRoot(nodePath, root) {
+				nodes[nodePath] = node
+				break
+			}
+		}
+	}
+	for _, root := range roots {
+		if !containsString(cache.Roots, root) {
+			self.logger.Log(LevelWarn, "Snapshot cache does not cover root.", "cache", cachePath, "path", root)
+		}
+	}
+	self.logger.Log(LevelWarn, "Rendering from stale snapshot cache.", "cache", cachePath, "savedAt", cache.SavedAt.Format(time.RFC3339), "nodes", len(nodes))
+	zkData := self.newZkData(conn, roots)
+	zkData.snapshot = nodes
+	return zkData, nil
+}
+
+// isStale tells whether the data comes from the cache and was not reconciled
+// with zookeeper yet.
+func (self *Agent) isStale() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.stale
+}
+
+func (self *Agent) setStale(stale bool) {
+	self.lock.Lock()
+	self.stale = stale
+	self.lock.Unlock()
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package ZkAgent
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotCache(t *testing.T) {
+	dir := t.TempDir()
+	config := validConfig()
+	config.Cache = &CacheConfig{Path: filepath.Join(dir, "snapshot.json")}
+	agent := newTestAgent(t, config, &fakeRunner{}, testSnapshot())
+	agent.zkData.Roots = []string{"/app", "/other"}
+	agent.saveCache(agent.zkData)
+	if info, err := os.Stat(config.Cache.Path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("cache file %v, %v, want it private", info, err)
+	}
+
+	tests := []struct {
+		name  string
+		roots []string
+		paths []string
+	}{
+		{name: "all roots", roots: []string{"/app", "/other"}, paths: []string{"/app", "/app/a", "/app/b", "/other"}},
+		{name: "one root", roots: []string{"/app"}, paths: []string{"/app", "/app/a", "/app/b"}},
+		{name: "nested root", roots: []string{"/app/a"}, paths: []string{"/app/a"}},
+		{name: "uncovered root", roots: []string{"/missing"}},
+	}
+	for _, test := range tests {
+		zkData, err := agent.loadCache(nil, test.roots)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		snapshot := zkData.Snapshot()
+		var paths []string
+		for _, nodePath := range test.paths {
+			if _, ok := snapshot[nodePath]; ok {
+				paths = append(paths, nodePath)
+			}
+		}
+		if len(snapshot) != len(test.paths) || !reflect.DeepEqual(paths, test.paths) {
+			t.Errorf("%s: loaded %v, want %v", test.name, snapshot, test.paths)
+		}
+	}
+	if zkData, _ := agent.loadCache(nil, []string{"/app"}); zkData.Snapshot()["/app/a"].Value != "1" {
+		t.Error("node value lost in the cache")
+	}
+}
+
+func TestSnapshotCacheInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"broken.json":  "{",
+		"version.json": `{"version": 2, "nodes": {}}`,
+		"missing.json": "",
+	} {
+		config := validConfig()
+		config.Cache = &CacheConfig{Path: filepath.Join(dir, name)}
+		if len(content) > 0 {
+			writeFile(t, dir, name, content)
+		}
+		agent := newTestAgent(t, config, &fakeRunner{}, nil)
+		if _, err := agent.loadCache(nil, []string{"/app"}); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
+
+func TestSnapshotCacheDryRun(t *testing.T) {
+	config := validConfig()
+	config.Cache = &CacheConfig{Path: filepath.Join(t.TempDir(), "snapshot.json")}
+	agent := newTestAgent(t, config, &fakeRunner{}, testSnapshot())
+	agent.dryRun = true
+	agent.saveCache(agent.zkData)
+	if _, err := os.Stat(config.Cache.Path); !os.IsNotExist(err) {
+		t.Errorf("dry run saved the cache: %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package ZkAgent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// output is the rendered content of one target file.
+type output struct {
+	target string
+	data   []byte
+}
+
+// fileChange is the planned update of one target file: a new content, or its
+// removal. The previous content is kept so that the change can be undone.
+type fileChange struct {
+	target       string
+	data         []byte
+	remove       bool
+	previous     []byte
+	existed      bool
+	hash         string
+	previousHash string
+	unchanged    bool
+	opts         FileOptions
+
+	staged  string
+	applied bool
+}
+
+// changeSet is a group of file changes applied, and undone, together.
+type changeSet []*fileChange
+
+// planChanges compares the outputs and the files to remove with the disk.
+// Files whose content would not change are marked unchanged, unless force.
+func planChanges(outputs []output, removals []string, force bool, opts FileOptions) (changeSet, error) {
+	var changes changeSet
+	for _, out := range outputs {
+		previous, existed, err := readPrevious(out.target)
+		if err != nil {
+			return nil, err
+		}
+		change := &fileChange{
+			target:   out.target,
+			data:     out.data,
+			previous: previous,
+			existed:  existed,
+			hash:     contentHash(out.data),
+			opts:     opts,
+		}
+		if existed {
+			change.previousHash = contentHash(previous)
+		}
+		change.unchanged = change.hash == change.previousHash && !force
+		changes = append(changes, change)
+	}
+	for _, target := range removals {
+		previous, existed, err := readPrevious(target)
+		if err != nil {
+			return nil, err
+		}
+		if !existed {
+			continue
+		}
+		changes = append(changes, &fileChange{
+			target:       target,
+			remove:       true,
+			previous:     previous,
+			existed:      true,
+			previousHash: contentHash(previous),
+			opts:         opts,
+		})
+	}
+	return changes, nil
+}
+
+// pending returns the changes that modify the disk.
+func (self changeSet) pending() changeSet {
+	var res changeSet
+	for _, change := range self {
+		if !change.unchanged {
+			res = append(res, change)
+		}
+	}
+	return res
+}
+
+// stagedFiles maps the target paths to their staging files.
+func (self changeSet) stagedFiles() map[string]string {
+	res := make(map[string]string, len(self))
+	for _, change := range self {
+		if len(change.staged) > 0 {
+			res[change.target] = change.staged
+		}
+	}
+	return res
+}
+
+// files returns the target paths of the changes.
+func (self changeSet) files() []string {
+	res := make([]string, 0, len(self))
+	for _, change := range self {
+		res = append(res, change.target)
+	}
+	return res
+}
+
+// hashes returns a digest of the new and of the previous content of all the
+// files. For a single file they are the hashes of its content.
+func (self changeSet) hashes() (string, string) {
+	if len(self) == 1 {
+		return self[0].hash, self[0].previousHash
+	}
+	var current, previous []string
+	for _, change := range self {
+		if !change.remove {
+			current = append(current, change.target+":"+change.hash)
+		}
+		if change.existed {
+			previous = append(previous, change.target+":"+change.previousHash)
+		}
+	}
+	return combineHashes(current), combineHashes(previous)
+}
+
+func combineHashes(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	sort.Strings(lines)
+	return contentHash([]byte(strings.Join(lines, "\n")))
+}
+
+// stage writes the new content of every change to a staging file.
+func (self changeSet) stage() error {
+	for _, change := range self {
+		if change.remove {
+			continue
+		}
+		staged, err := stageFile(change.target, change.data, change.opts)
+		if err != nil {
+			self.discard()
+			return fmt.Errorf("Stage `%s` failed, cause by: %+v", change.target, err)
+		}
+		change.staged = staged
+	}
+	return nil
+}
+
+// discard removes the staging files which were not promoted.
+func (self changeSet) discard() {
+	for _, change := range self {
+		if len(change.staged) > 0 {
+			os.Remove(change.staged)
+			change.staged = ""
+		}
+	}
+}
+
+// promote moves the staged files over their targets and removes the files to
+// remove. If any step fails, the changes already applied are undone.
+func (self changeSet) promote() error {
+	for _, change := range self {
+		var err error
+		if change.remove {
+			err = os.Remove(change.target)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = promoteFile(change.staged, change.target, change.opts)
+		}
+		if err != nil {
+			err = fmt.Errorf("Promote `%s` failed, cause by: %+v", change.target, err)
+			self.discard()
+			if rerr := self.restore(); rerr != nil {
+				err = fmt.Errorf("%+v; %+v", err, rerr)
+			}
+			return err
+		}
+		change.staged = ""
+		change.applied = true
+	}
+	return nil
+}
+
+// restore puts back the previous content of every applied change.
+func (self changeSet) restore() error {
+	var failed []string
+	for _, change := range self {
+		if !change.applied {
+			continue
+		}
+		if err := restoreFile(change.target, change.previous, change.existed, change.opts); err != nil {
+			failed = append(failed, fmt.Sprintf("restore `%s` failed, cause by: %+v", change.target, err))
+			continue
+		}
+		change.applied = false
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
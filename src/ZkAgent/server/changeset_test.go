@@ -0,0 +1,124 @@
+package ZkAgent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testFileOptions = FileOptions{Mode: defaultFileMode, Uid: -1, Gid: -1}
+
+// readTarget returns the content of a file, or "<none>" when it does not
+// exist.
+func readTarget(t *testing.T, filePath string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return "<none>"
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPlanChanges(t *testing.T) {
+	dir := t.TempDir()
+	same := writeFile(t, dir, "same", "x")
+	changed := writeFile(t, dir, "changed", "old")
+	created := filepath.Join(dir, "created")
+	removed := writeFile(t, dir, "removed", "gone")
+	outputs := []output{
+		{target: same, data: []byte("x")},
+		{target: changed, data: []byte("new")},
+		{target: created, data: []byte("new")},
+	}
+	tests := []struct {
+		force bool
+		want  map[string]bool
+	}{
+		{false, map[string]bool{same: true, changed: false, created: false, removed: false}},
+		{true, map[string]bool{same: false, changed: false, created: false, removed: false}},
+	}
+	for _, test := range tests {
+		changes, err := planChanges(outputs, []string{removed, filepath.Join(dir, "missing")}, test.force, testFileOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != len(test.want) {
+			t.Fatalf("force=%v: %d changes, want %d", test.force, len(changes), len(test.want))
+		}
+		for _, change := range changes {
+			if change.unchanged != test.want[change.target] {
+				t.Errorf("force=%v: %s unchanged=%v", test.force, change.target, change.unchanged)
+			}
+		}
+	}
+}
+
+func TestChangeSetPromoteRestore(t *testing.T) {
+	dir := t.TempDir()
+	changed := writeFile(t, dir, "changed", "old")
+	created := filepath.Join(dir, "created")
+	removed := writeFile(t, dir, "removed", "gone")
+	changes, err := planChanges([]output{
+		{target: changed, data: []byte("new")},
+		{target: created, data: []byte("new")},
+	}, []string{removed}, false, testFileOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := changes.stage(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTarget(t, changed); got != "old" {
+		t.Errorf("staging changed the target to %q", got)
+	}
+	if err := changes.promote(); err != nil {
+		t.Fatal(err)
+	}
+	for target, want := range map[string]string{changed: "new", created: "new", removed: "<none>"} {
+		if got := readTarget(t, target); got != want {
+			t.Errorf("after promote %s = %q, want %q", filepath.Base(target), got, want)
+		}
+	}
+	if err := changes.restore(); err != nil {
+		t.Fatal(err)
+	}
+	for target, want := range map[string]string{changed: "old", created: "<none>", removed: "gone"} {
+		if got := readTarget(t, target); got != want {
+			t.Errorf("after restore %s = %q, want %q", filepath.Base(target), got, want)
+		}
+	}
+}
+
+func TestChangeSetPromoteFailure(t *testing.T) {
+	dir := t.TempDir()
+	first := writeFile(t, dir, "first", "old")
+	second := writeFile(t, dir, "second", "old")
+	changes, err := planChanges([]output{
+		{target: first, data: []byte("new")},
+		{target: second, data: []byte("new")},
+	}, nil, false, testFileOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := changes.stage(); err != nil {
+		t.Fatal(err)
+	}
+	// the second promotion fails, the first one must be undone
+	os.Remove(changes[1].staged)
+	if err := changes.promote(); err == nil {
+		t.Fatal("promote succeeded without the staged file")
+	}
+	for _, target := range []string{first, second} {
+		if got := readTarget(t, target); got != "old" {
+			t.Errorf("%s = %q, want the previous content", filepath.Base(target), got)
+		}
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("%d files left in the directory, want no staging file", len(entries))
+	}
+}
@@ -0,0 +1,321 @@
+package ZkAgent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Codec decodes the value of a node for the `Parsed` field seen by templates.
+type Codec func(node ZkNode) (interface{}, error)
+
+// codecs are the codecs that can be named in the configuration.
+var codecs = map[string]Codec{
+	"raw": func(node ZkNode) (interface{}, error) {
+		return node.Value, nil
+	},
+	"json": func(node ZkNode) (interface{}, error) {
+		return decodeJSON(node.Value)
+	},
+	"yaml": func(node ZkNode) (interface{}, error) {
+		return decodeYAML(node.Value)
+	},
+	"toml": func(node ZkNode) (interface{}, error) {
+		return decodeTOML(node.Value)
+	},
+	"properties": func(node ZkNode) (interface{}, error) {
+		return decodeProperties(node.Value)
+	},
+	"query": func(node ZkNode) (interface{}, error) {
+		return decodeQuery(node.Value)
+	},
+	"dubbo": decodeDubboNode,
+}
+
+// codecRule applies a codec to the nodes whose path matches pattern.
+type codecRule struct {
+	pattern *regexp.Regexp
+	codec   Codec
+}
+
+// decodeNodes returns a copy of data where every node under roots covered by
+// a rule, or by the default codec, carries its decoded value in Parsed. A node
+// that fails to decode gets ParseError instead; the other nodes, and the empty
+// values such as those of the parent nodes, are unaffected.
+func decodeNodes(data Snapshot, roots []string, rules []codecRule, defaultCodec Codec) Snapshot {
+	if len(rules) == 0 && defaultCodec == nil {
+		return data
+	}
+	res := make(Snapshot, len(data))
+	for nodePath, node := range data {
+		res[nodePath] = node
+		covered := false
+		for _, root := range roots {
+			if isUnderRoot(nodePath, root) {
+				covered = true
+				break
+			}
+		}
+		if !covered || len(node.Value) == 0 {
+			continue
+		}
+		codec := defaultCodec
+		for _, rule := range rules {
+			if rule.pattern.MatchString(nodePath) {
+				codec = rule.codec
+				break
+			}
+		}
+		if codec != nil {
+			parsed, err := codec(node)
+			if err != nil {
+				node.ParseError = err.Error()
+			} else {
+				node.Parsed = parsed
+			}
+		}
+		res[nodePath] = node
+	}
+	return res
+}
+
+func decodeJSON(value string) (interface{}, error) {
+	var res interface{}
+	if err := json.Unmarshal([]byte(value), &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func decodeYAML(value string) (interface{}, error) {
+	var res interface{}
+	if err := yaml.Unmarshal([]byte(value), &res); err != nil {
+		return nil, err
+	}
+	return normalizeYAML(res), nil
+}
+
+// normalizeYAML turns the map[interface{}]interface{} produced by yaml into
+// map[string]interface{}, so that decoded values look the same as JSON ones.
+func normalizeYAML(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			res[fmt.Sprint(k)] = normalizeYAML(item)
+		}
+		return res
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeYAML(item)
+		}
+	}
+	return val
+}
+
+func decodeTOML(value string) (interface{}, error) {
+	res := make(map[string]interface{})
+	if _, err := toml.Decode(value, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// decodeProperties parses a Java properties document like
+// java.util.Properties.load: `key=value`, `key: value` or `key value` lines,
+// `#` and `!` comments, `\` line continuations and the `\t`, `\n`, `\r`,
+// `\f` and `\uXXXX` escapes, any other escaped character standing for
+// itself, e.g. `key\=x=y` for the key `key=x`.
+func decodeProperties(value string) (map[string]string, error) {
+	res := make(map[string]string)
+	value = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(value)
+	logical := ""
+	continued := false
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimLeft(line, " \t\f")
+		if !continued && (len(line) == 0 || line[0] == '#' || line[0] == '!') {
+			continue
+		}
+		// an odd number of trailing backslashes escapes the line break
+		escapes := len(line) - len(strings.TrimRight(line, "\\"))
+		if continued = escapes%2 == 1; continued {
+			logical += line[:len(line)-1]
+			continue
+		}
+		logical += line
+		if err := addProperty(res, logical); err != nil {
+			return nil, err
+		}
+		logical = ""
+	}
+	if len(logical) > 0 {
+		if err := addProperty(res, logical); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// addProperty splits a logical line at the first unescaped `=`, `:` or
+// whitespace, and adds the unescaped key and value to res.
+func addProperty(res map[string]string, line string) error {
+	end := 0
+	for end < len(line) && !strings.ContainsRune("=: \t\f", rune(line[end])) {
+		if line[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end > len(line) {
+		end = len(line)
+	}
+	rest := strings.TrimLeft(line[end:], " \t\f")
+	if len(rest) > 0 && (rest[0] == '=' || rest[0] == ':') {
+		rest = strings.TrimLeft(rest[1:], " \t\f")
+	}
+	key, err := unescapeProperty(line[:end])
+	if err != nil {
+		return err
+	}
+	val, err := unescapeProperty(rest)
+	if err != nil {
+		return err
+	}
+	res[key] = val
+	return nil
+}
+
+func unescapeProperty(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var res strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			res.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			break
+		}
+		switch s[i] {
+		case 't':
+			res.WriteByte('\t')
+		case 'n':
+			res.WriteByte('\n')
+		case 'r':
+			res.WriteByte('\r')
+		case 'f':
+			res.WriteByte('\f')
+		case 'u':
+			r, err := parseUnicodeEscape(s[i+1:])
+			if err != nil {
+				return "", err
+			}
+			i += 4
+			// a surrogate pair is written as two escapes
+			if utf16.IsSurrogate(r) && strings.HasPrefix(s[i+1:], "\\u") {
+				if low, err := parseUnicodeEscape(s[i+3:]); err == nil {
+					if pair := utf16.DecodeRune(r, low); pair != unicode.ReplacementChar {
+						r = pair
+						i += 6
+					}
+				}
+			}
+			res.WriteRune(r)
+		default:
+			res.WriteByte(s[i])
+		}
+	}
+	return res.String(), nil
+}
+
+// parseUnicodeEscape parses the 4 hexadecimal digits starting s.
+func parseUnicodeEscape(s string) (rune, error) {
+	if len(s) < 4 {
+		return 0, fmt.Errorf("malformed \\uxxxx escape `\\u%s`", s)
+	}
+	code, err := strconv.ParseUint(s[:4], 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("malformed \\uxxxx escape `\\u%s`", s[:4])
+	}
+	return rune(code), nil
+}
+
+// decodeQuery parses a URL query string, keeping the first value of each key.
+func decodeQuery(value string) (map[string]string, error) {
+	values, err := url.ParseQuery(strings.TrimPrefix(strings.TrimSpace(value), "?"))
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string, len(values))
+	for k := range values {
+		res[k] = values.Get(k)
+	}
+	return res, nil
+}
+
+// DubboURL is a decoded Dubbo provider or consumer URL such as
+// `dubbo://10.0.0.1:20880/com.foo.DemoService?version=1.0.0`.
+type DubboURL struct {
+	Protocol string
+	Host     string
+	Port     int
+	Path     string
+	Username string
+	Password string
+	Params   map[string]string
+}
+
+// decodeDubboNode decodes the URL a Dubbo registry stores in the escaped node
+// name, or in the value when it is not empty.
+func decodeDubboNode(node ZkNode) (interface{}, error) {
+	raw := strings.TrimSpace(node.Value)
+	if len(raw) == 0 || !strings.Contains(raw, "://") {
+		name, err := url.QueryUnescape(path.Base(node.Path))
+		if err != nil {
+			return nil, err
+		}
+		raw = name
+	}
+	return decodeDubbo(raw)
+}
+
+func decodeDubbo(raw string) (*DubboURL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid dubbo url `%s`", raw)
+	}
+	res := &DubboURL{
+		Protocol: u.Scheme,
+		Host:     u.Hostname(),
+		Path:     strings.TrimPrefix(u.Path, "/"),
+		Params:   make(map[string]string),
+	}
+	if port := u.Port(); len(port) > 0 {
+		if res.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid port in dubbo url `%s`", raw)
+		}
+	}
+	if u.User != nil {
+		res.Username = u.User.Username()
+		res.Password, _ = u.User.Password()
+	}
+	for k, v := range u.Query() {
+		res.Params[k] = v[0]
+	}
+	return res, nil
+}
@@ -0,0 +1,68 @@
+package ZkAgent
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestDecodeNodes(t *testing.T) {
+	data := Snapshot{
+		"/app":        ZkNode{Path: "/app", Childs: []string{"conf", "raw", "broken"}},
+		"/app/conf":   ZkNode{Path: "/app/conf", Value: `{"port": 80}`},
+		"/app/raw":    ZkNode{Path: "/app/raw", Value: "plain"},
+		"/app/broken": ZkNode{Path: "/app/broken", Value: "{"},
+		"/other":      ZkNode{Path: "/other", Value: `{"port": 81}`},
+	}
+	rules := []codecRule{{pattern: regexp.MustCompile(`/raw$`), codec: codecs["raw"]}}
+	res := decodeNodes(data, []string{"/app"}, rules, codecs["json"])
+	tests := []struct {
+		path       string
+		parsed     interface{}
+		parseError bool
+	}{
+		{path: "/app"},
+		{path: "/app/conf", parsed: map[string]interface{}{"port": float64(80)}},
+		{path: "/app/raw", parsed: "plain"},
+		{path: "/app/broken", parseError: true},
+		{path: "/other"},
+	}
+	for _, test := range tests {
+		node := res[test.path]
+		if !reflect.DeepEqual(node.Parsed, test.parsed) || (len(node.ParseError) > 0) != test.parseError {
+			t.Errorf("%s: parsed %#v, error %q", test.path, node.Parsed, node.ParseError)
+		}
+	}
+	if data["/app/conf"].Parsed != nil {
+		t.Error("decodeNodes modified its input")
+	}
+}
+
+func TestDecodeProperties(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  map[string]string
+		err   bool
+	}{
+		{name: "separators", value: "a=1\nb: 2\nc 3\nd\n", want: map[string]string{"a": "1", "b": "2", "c": "3", "d": ""}},
+		{name: "spaces", value: "  a  =  1 \n\tb:2", want: map[string]string{"a": "1 ", "b": "2"}},
+		{name: "comments", value: "# a=1\n! b=2\n\nc=3", want: map[string]string{"c": "3"}},
+		{name: "continuation", value: "a=1,\\\n    2,\\\n    3\r\nb=4", want: map[string]string{"a": "1,2,3", "b": "4"}},
+		{name: "escaped backslash", value: "a=x\\\\\nb=y", want: map[string]string{"a": `x\`, "b": "y"}},
+		{name: "escaped separator", value: `key\=x\:y\ z=v`, want: map[string]string{"key=x:y z": "v"}},
+		{name: "escapes", value: `a=\t\n\q\u00e9\ud83d\ude00`, want: map[string]string{"a": "\t\nqé😀"}},
+		{name: "continued at the end", value: "a=1\\", want: map[string]string{"a": "1"}},
+		{name: "invalid unicode", value: `a=\u12`, err: true},
+	}
+	for _, test := range tests {
+		got, err := decodeProperties(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		if !test.err && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package ZkAgent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultBackoff    = time.Second
+	defaultMaxBackoff = 30 * time.Second
+	// commandWaitDelay bounds the wait for the output of a command once it
+	// exited or was killed.
+	commandWaitDelay = 5 * time.Second
+)
+
+// Command is a check or reload command. Shell is run through the system
+// shell, Argv is executed directly; each of them is a template.
+type Command struct {
+	Shell   string
+	Argv    []string
+	Timeout time.Duration
+	// MaxAttempts bounds the runs of a failing command, waiting Backoff
+	// between the first two and doubling the wait, up to MaxBackoff, after
+	// each further failure.
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+func (self *Command) IsEmpty() bool {
+	return len(self.Shell) == 0 && len(self.Argv) == 0
+}
+
+func newCommand(config CommandConfig) Command {
+	command := Command{
+		Shell:       config.Shell,
+		Argv:        config.Argv,
+		Timeout:     time.Duration(config.Timeout),
+		MaxAttempts: config.MaxAttempts,
+		Backoff:     time.Duration(config.Backoff),
+		MaxBackoff:  time.Duration(config.MaxBackoff),
+	}
+	if command.MaxAttempts <= 0 {
+		command.MaxAttempts = 1
+	}
+	if command.Backoff <= 0 {
+		command.Backoff = defaultBackoff
+	}
+	if command.MaxBackoff <= 0 {
+		command.MaxBackoff = defaultMaxBackoff
+	}
+	return command
+}
+
+// Invocation is a rendered command, ready to run.
+type Invocation struct {
+	// Shell is run with `sh -c`, or `cmd /c` on Windows, when Argv is empty.
+	Shell string
+	Argv  []string
+	// Env is added to the environment of the agent, as `KEY=value` entries.
+	Env     []string
+	Timeout time.Duration
+}
+
+func (self *Invocation) String() string {
+	if len(self.Argv) > 0 {
+		return strings.Join(self.Argv, " ")
+	}
+	return self.Shell
+}
+
+// CommandResult is the captured outcome of a command run.
+type CommandResult struct {
+	Stdout string
+	Stderr string
+	// ExitCode is -1 when the process did not exit by itself, such as when
+	// it was killed on timeout.
+	ExitCode int
+}
+
+// CommandRunner executes the check and reload commands of the pipelines. Run
+// returns an error when the command could not be started, timed out or
+// exited with a non-zero status; the result is set whenever it ran.
+type CommandRunner interface {
+	Run(invocation *Invocation) (*CommandResult, error)
+}
+
+type execRunner struct{}
+
+func (execRunner) Run(invocation *Invocation) (*CommandResult, error) {
+	return runInvocation(invocation)
+}
+
+// runInvocation starts the command in its own process group, so that on
+// timeout the whole group, including the children of a shell, is killed.
+func runInvocation(invocation *Invocation) (*CommandResult, error) {
+	var cmd *exec.Cmd
+	switch {
+	case len(invocation.Argv) > 0:
+		cmd = exec.Command(invocation.Argv[0], invocation.Argv[1:]...)
+	case runtime.GOOS == "windows":
+		cmd = exec.Command("cmd", "/c", invocation.Shell)
+	default:
+		cmd = exec.Command("sh", "-c", invocation.Shell)
+	}
+	cmd.Env = append(os.Environ(), invocation.Env...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	// a daemon started by the command may keep its output open
+	cmd.WaitDelay = commandWaitDelay
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var timeout <-chan time.Time
+	if invocation.Timeout > 0 {
+		timer := time.NewTimer(invocation.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var err error
+	select {
+	case err = <-done:
+		if errors.Is(err, exec.ErrWaitDelay) {
+			// the command itself succeeded, only its output is cut short
+			err = nil
+		}
+	case <-timeout:
+		killProcessGroup(cmd)
+		<-done
+		err = fmt.Errorf("timed out after %s", invocation.Timeout)
+	}
+	return &CommandResult{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		ExitCode: cmd.ProcessState.ExitCode(),
+	}, err
+}
+
+// render executes the command templates with funcs against data.
+func (self *Command) render(data Snapshot, funcs template.FuncMap, strict bool) (*Invocation, error) {
+	invocation := &Invocation{Timeout: self.Timeout}
+	renderOne := func(text string) (string, error) {
+		tmpl := template.New("command").Funcs(funcs)
+		if strict {
+			tmpl = tmpl.Option("missingkey=error")
+		}
+		tmpl, err := tmpl.Parse(text)
+		if err != nil {
+			return "", err
+		}
+		res, err := executeTemplate(tmpl, data)
+		return string(res), err
+	}
+	if len(self.Argv) > 0 {
+		for _, arg := range self.Argv {
+			res, err := renderOne(arg)
+			if err != nil {
+				return nil, err
+			}
+			invocation.Argv = append(invocation.Argv, res)
+		}
+		return invocation, nil
+	}
+	res, err := renderOne(self.Shell)
+	if err != nil {
+		return nil, err
+	}
+	invocation.Shell = res
+	return invocation, nil
+}
+
+// execute runs the invocation until it succeeds or MaxAttempts is reached,
+// backing off between the attempts. It gives up waiting when the agent stops.
+func (self *Agent) execute(command *Command, invocation *Invocation) (*CommandResult, int, error) {
+	backoff := command.Backoff
+	for attempt := 1; ; attempt++ {
+		result, err := self.runner.Run(invocation)
+		if err == nil || attempt >= command.MaxAttempts {
+			return result, attempt, err
+		}
+		self.logger.Log(LevelWarn, "Command failed, will retry.", "command", invocation, "attempt", attempt, "maxAttempts", command.MaxAttempts, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-self.stop:
+			return result, attempt, err
+		}
+		if backoff *= 2; backoff > command.MaxBackoff {
+			backoff = command.MaxBackoff
+		}
+	}
+}
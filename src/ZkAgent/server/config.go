@@ -0,0 +1,919 @@
+package ZkAgent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultSessionTimeout = 10 * time.Second
+
+// defaultStateDir returns where the agent keeps its own files when stateDir
+// is not configured.
+func defaultStateDir() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "zk-agent")
+	}
+	return "/var/lib/zk-agent"
+}
+
+// Config is the typed configuration of the agent. It can be loaded from JSON,
+// YAML or TOML documents, see LoadConfig.
+//
+// The top-level `zkDataPath`, `combine`, `pathMatcher` and `shellCommand`
+// keys are the legacy single-section form; each `combine` entry is turned
+// into a pipeline sharing those settings.
+type Config struct {
+	// ZkServer is the connection string, `host1:2181,host2:2181/chroot`, or
+	// the list of its servers, the last one possibly followed by the chroot.
+	ZkServer       StringList       `json:"zkServer" yaml:"zkServer" toml:"zkServer"`
+	SessionTimeout Duration         `json:"sessionTimeout" yaml:"sessionTimeout" toml:"sessionTimeout"`
+	Pipelines      []PipelineConfig `json:"pipelines" yaml:"pipelines" toml:"pipelines"`
+	Groups         []GroupConfig    `json:"groups" yaml:"groups" toml:"groups"`
+	// Auth are added to the zookeeper session before anything is read.
+	Auth []AuthConfig `json:"auth" yaml:"auth" toml:"auth"`
+	// NoAuthPolicy is `fail` (the default) to fail the sync when a node cannot
+	// be read for lack of permission, or `skip` to leave the node out.
+	NoAuthPolicy string `json:"noAuthPolicy" yaml:"noAuthPolicy" toml:"noAuthPolicy"`
+	// Exec is the child process supervised by `zk-agent exec`.
+	Exec *ExecConfig `json:"exec" yaml:"exec" toml:"exec"`
+	// StateDir holds the files the agent keeps for itself, such as the
+	// manifests of the fan-out pipelines. It defaults to /var/lib/zk-agent, or
+	// %ProgramData%\zk-agent on Windows.
+	StateDir string `json:"stateDir" yaml:"stateDir" toml:"stateDir"`
+	// Cache keeps the last data read from zookeeper on disk, to render from
+	// when zookeeper cannot be reached at startup.
+	Cache *CacheConfig `json:"cache" yaml:"cache" toml:"cache"`
+	// Admin enables the HTTP admin API.
+	Admin *AdminConfig `json:"admin" yaml:"admin" toml:"admin"`
+
+	ZkDataPath   StringList    `json:"zkDataPath" yaml:"zkDataPath" toml:"zkDataPath"`
+	Combine      StringList    `json:"combine" yaml:"combine" toml:"combine"`
+	PathMatcher  string        `json:"pathMatcher" yaml:"pathMatcher" toml:"pathMatcher"`
+	ShellCommand CommandConfig `json:"shellCommand" yaml:"shellCommand" toml:"shellCommand"`
+}
+
+// PipelineConfig is the configuration of a single Pipeline.
+type PipelineConfig struct {
+	Name        string     `json:"name" yaml:"name" toml:"name"`
+	ZkDataPath  StringList `json:"zkDataPath" yaml:"zkDataPath" toml:"zkDataPath"`
+	PathMatcher string     `json:"pathMatcher" yaml:"pathMatcher" toml:"pathMatcher"`
+	Template    string     `json:"template" yaml:"template" toml:"template"`
+	Target      string     `json:"target" yaml:"target" toml:"target"`
+	// ShellCommand runs after the targets were replaced, see CommandConfig.
+	ShellCommand CommandConfig `json:"shellCommand" yaml:"shellCommand" toml:"shellCommand"`
+	// CheckCommand runs against the staged file, available in the command
+	// template as `{{ staged }}`, before it replaces the target.
+	CheckCommand CommandConfig `json:"checkCommand" yaml:"checkCommand" toml:"checkCommand"`
+	// Signal reloads the consumer with a signal instead of `shellCommand`.
+	Signal *SignalConfig `json:"signal" yaml:"signal" toml:"signal"`
+	// Force rewrites the target and runs the command on every change, even
+	// when the rendered content is identical to the file on disk.
+	Force bool `json:"force" yaml:"force" toml:"force"`
+	// Strict fails the render when the templates reference a missing key or
+	// node, instead of rendering an empty value.
+	Strict bool `json:"strict" yaml:"strict" toml:"strict"`
+	// Codec decodes every node value into the `Parsed` field, unless one of
+	// the Codecs rules matches the node path first.
+	Codec  string        `json:"codec" yaml:"codec" toml:"codec"`
+	Codecs []CodecConfig `json:"codecs" yaml:"codecs" toml:"codecs"`
+	// FanOut renders the template once per child node, `target` being a
+	// template of the file name.
+	FanOut *FanOutConfig `json:"fanOut" yaml:"fanOut" toml:"fanOut"`
+	// Wait coalesces bursts of changes into a single reload.
+	Wait WaitConfig `json:"wait" yaml:"wait" toml:"wait"`
+	// Group makes the pipeline a member of the named group, which renders,
+	// validates and reloads all its members together.
+	Group string `json:"group" yaml:"group" toml:"group"`
+
+	// FileMode is the permission of the target file, an octal string, "0644"
+	// by default.
+	FileMode FileMode `json:"fileMode" yaml:"fileMode" toml:"fileMode"`
+	Uid      *int     `json:"uid" yaml:"uid" toml:"uid"`
+	Gid      *int     `json:"gid" yaml:"gid" toml:"gid"`
+	Backup   bool     `json:"backup" yaml:"backup" toml:"backup"`
+}
+
+// GroupConfig is the configuration of a Group. Its `shellCommand` and `wait`
+// replace those of the member pipelines; the `checkCommand` of the members
+// still runs against each of their staged files, the one of the group once
+// all of them are staged.
+type GroupConfig struct {
+	Name         string        `json:"name" yaml:"name" toml:"name"`
+	CheckCommand CommandConfig `json:"checkCommand" yaml:"checkCommand" toml:"checkCommand"`
+	ShellCommand CommandConfig `json:"shellCommand" yaml:"shellCommand" toml:"shellCommand"`
+	Signal       *SignalConfig `json:"signal" yaml:"signal" toml:"signal"`
+	Wait         WaitConfig    `json:"wait" yaml:"wait" toml:"wait"`
+}
+
+// ExecConfig is the child process of a Supervisor. `command` is a list of
+// arguments, executed directly even when it holds a single one, or a command
+// line string run through the shell. On changes the
+// child is sent `reloadSignal`, or when unset restarted: it is sent
+// `killSignal` (TERM by default) and killed if still running after
+// `killTimeout` (10s by default).
+type ExecConfig struct {
+	Command      CommandConfig `json:"command" yaml:"command" toml:"command"`
+	ReloadSignal string        `json:"reloadSignal" yaml:"reloadSignal" toml:"reloadSignal"`
+	KillSignal   string        `json:"killSignal" yaml:"killSignal" toml:"killSignal"`
+	KillTimeout  Duration      `json:"killTimeout" yaml:"killTimeout" toml:"killTimeout"`
+}
+
+// AuthConfig is an auth entry of the zookeeper session. `scheme` is `digest`
+// by default, its credentials being `user:password`. They are given inline
+// as `credentials`, or read from `credentialsFile` or from the environment
+// variable `credentialsEnv` when connecting.
+type AuthConfig struct {
+	Scheme          string `json:"scheme" yaml:"scheme" toml:"scheme"`
+	Credentials     string `json:"credentials" yaml:"credentials" toml:"credentials"`
+	CredentialsFile string `json:"credentialsFile" yaml:"credentialsFile" toml:"credentialsFile"`
+	CredentialsEnv  string `json:"credentialsEnv" yaml:"credentialsEnv" toml:"credentialsEnv"`
+}
+
+// CacheConfig is the snapshot cache. The data is saved to `path` after every
+// successful sync; when no session is established within `timeout` (10s by
+// default) at startup, the targets are rendered from it, marked stale, until
+// zookeeper is reachable again. `zk-agent render` falls back to the cache
+// once its own timeout is over.
+type CacheConfig struct {
+	Path    string   `json:"path" yaml:"path" toml:"path"`
+	Timeout Duration `json:"timeout" yaml:"timeout" toml:"timeout"`
+}
+
+// AdminConfig is the listener of the admin API. `listen` is a TCP address
+// such as `127.0.0.1:8500`, or `unix:` followed by the path of a unix socket.
+// It also serves the Prometheus metrics on `/metrics`.
+type AdminConfig struct {
+	Listen string `json:"listen" yaml:"listen" toml:"listen"`
+}
+
+// SignalConfig sends `signal` (HUP by default) to the process whose pid is in
+// `pidFile`, or to the processes named `process` (Linux only). With both, the
+// process of the pidfile must be named `process`. The process must be running,
+// and on Linux have started before the pidfile was written, or the reload
+// fails.
+type SignalConfig struct {
+	PidFile string `json:"pidFile" yaml:"pidFile" toml:"pidFile"`
+	Process string `json:"process" yaml:"process" toml:"process"`
+	Signal  string `json:"signal" yaml:"signal" toml:"signal"`
+}
+
+// WaitConfig is the quiescence window of a pipeline: a reload happens once no
+// change has been seen for `min`, but at the latest `max` (4 times `min` by
+// default) after the first one.
+type WaitConfig struct {
+	Min Duration `json:"min" yaml:"min" toml:"min"`
+	Max Duration `json:"max" yaml:"max" toml:"max"`
+}
+
+// FanOutConfig renders one file per child of Path. Manifest defaults to
+// `<pipeline>.manifest` in the state directory. An existing file which is not
+// listed in the manifest is never overwritten: the render fails instead.
+type FanOutConfig struct {
+	Path     string `json:"path" yaml:"path" toml:"path"`
+	Manifest string `json:"manifest" yaml:"manifest" toml:"manifest"`
+}
+
+// CodecConfig selects the codec of the nodes whose path matches Pattern. The
+// codecs are `raw`, `json`, `yaml`, `toml`, `properties`, `query` (URL query
+// strings) and `dubbo` (Dubbo registry URLs).
+type CodecConfig struct {
+	Pattern string `json:"pattern" yaml:"pattern" toml:"pattern"`
+	Codec   string `json:"codec" yaml:"codec" toml:"codec"`
+}
+
+// LoadConfig reads the configuration file at configPath, choosing the decoder
+// by its extension (`.json`, `.yaml`/`.yml` or `.toml`). Unknown keys are
+// rejected. When the document decodes but is invalid, the returned error is a
+// ConfigErrors holding every problem found.
+func LoadConfig(configPath string) (*Config, error) {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	ext := strings.ToLower(filepath.Ext(configPath))
+	switch ext {
+	case ".json":
+		err = decodeJSONConfig(data, config)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, config)
+	case ".toml":
+		err = decodeTOMLConfig(data, config)
+	default:
+		return nil, fmt.Errorf("Unsupported configuration format `%s`.", ext)
+	}
+	if err != nil {
+		// the decoders do not tell which field a value error comes from
+		if fieldErr := findValueError(decodeGenericConfig(ext, data), reflect.TypeOf(Config{}), ""); fieldErr != nil {
+			err = fieldErr
+		}
+		return nil, fmt.Errorf("Parse configuration `%s` failed, cause by: %+v", configPath, err)
+	}
+	if errs := config.Validate(); len(errs) > 0 {
+		return nil, errs
+	}
+	config.normalize()
+	return config, nil
+}
+
+func decodeJSONConfig(data []byte, config *Config) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		offset := decoder.InputOffset()
+		switch e := err.(type) {
+		case *json.SyntaxError:
+			offset = e.Offset
+		case *json.UnmarshalTypeError:
+			offset = e.Offset
+		}
+		return fmt.Errorf("line %d: %v", lineOf(data, offset), err)
+	}
+	return nil
+}
+
+func decodeTOMLConfig(data []byte, config *Config) error {
+	meta, err := toml.Decode(string(data), config)
+	if err != nil {
+		return err
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, 0, len(undecoded))
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		return fmt.Errorf("unknown keys %s", strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// decodeGenericConfig decodes the configuration document into maps and
+// lists, or returns nil when it is not well-formed.
+func decodeGenericConfig(ext string, data []byte) interface{} {
+	var res interface{}
+	switch ext {
+	case ".json":
+		json.Unmarshal(data, &res)
+	case ".yaml", ".yml":
+		yaml.Unmarshal(data, &res)
+	case ".toml":
+		doc := make(map[string]interface{})
+		if _, err := toml.Decode(string(data), &doc); err == nil {
+			res = doc
+		}
+	}
+	return res
+}
+
+// valueSetter is implemented by the types decoding a value of any of the
+// configuration formats.
+type valueSetter interface {
+	set(val interface{}) error
+}
+
+// findValueError walks val, the generic form of a value of type typ at
+// field, and returns the error of the first value a valueSetter rejects.
+func findValueError(val interface{}, typ reflect.Type, field string) *ConfigError {
+	if setter, ok := reflect.New(typ).Interface().(valueSetter); ok {
+		if err := setter.set(val); err != nil {
+			return &ConfigError{Field: field, Message: err.Error()}
+		}
+		return nil
+	}
+	switch typ.Kind() {
+	case reflect.Ptr:
+		return findValueError(val, typ.Elem(), field)
+	case reflect.Slice:
+		items := reflect.ValueOf(val)
+		if items.Kind() != reflect.Slice {
+			return nil
+		}
+		for i := 0; i < items.Len(); i++ {
+			if err := findValueError(items.Index(i).Interface(), typ.Elem(), fmt.Sprintf("%s[%d]", field, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := make(map[string]interface{})
+		switch v := val.(type) {
+		case map[string]interface{}:
+			fields = v
+		case map[interface{}]interface{}:
+			for key, item := range v {
+				fields[fmt.Sprint(key)] = item
+			}
+		}
+		for i := 0; i < typ.NumField(); i++ {
+			key := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+			item, ok := fields[key]
+			if len(key) == 0 || !ok {
+				continue
+			}
+			if len(field) > 0 {
+				key = field + "." + key
+			}
+			if err := findValueError(item, typ.Field(i).Type, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func lineOf(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// ConfigError describes a problem with a single configuration field.
+type ConfigError struct {
+	Field   string
+	Message string
+}
+
+func (self *ConfigError) Error() string {
+	return fmt.Sprintf("`%s`: %s", self.Field, self.Message)
+}
+
+// ConfigErrors collects every problem found while validating a Config.
+type ConfigErrors []*ConfigError
+
+func (self ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(self))
+	for _, err := range self {
+		msgs = append(msgs, err.Error())
+	}
+	return "Invalid configuration:\n  " + strings.Join(msgs, "\n  ")
+}
+
+func (self *ConfigErrors) add(field string, format string, args ...interface{}) {
+	*self = append(*self, &ConfigError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks the configuration and returns all problems at once, or nil.
+func (self *Config) Validate() ConfigErrors {
+	var errs ConfigErrors
+	if len(self.ZkServer) == 0 {
+		errs.add("zkServer", "at least one server is required")
+	}
+	for i, server := range self.ZkServer {
+		if len(strings.TrimSpace(server)) == 0 {
+			errs.add(fmt.Sprintf("zkServer[%d]", i), "must not be empty")
+		}
+	}
+	if len(self.ZkServer) > 0 {
+		if _, _, err := parseServers(self.ZkServer); err != nil {
+			errs.add("zkServer", "%v", err)
+		}
+	}
+	for i, auth := range self.Auth {
+		field := fmt.Sprintf("auth[%d]", i)
+		sources := 0
+		for _, source := range []string{auth.Credentials, auth.CredentialsFile, auth.CredentialsEnv} {
+			if len(source) > 0 {
+				sources++
+			}
+		}
+		if sources != 1 {
+			errs.add(field, "exactly one of `credentials`, `credentialsFile` and `credentialsEnv` is required")
+		}
+	}
+	switch self.NoAuthPolicy {
+	case "", NoAuthFail, NoAuthSkip:
+	default:
+		errs.add("noAuthPolicy", "must be `%s` or `%s`", NoAuthFail, NoAuthSkip)
+	}
+	if self.SessionTimeout < 0 {
+		errs.add("sessionTimeout", "must not be negative")
+	}
+	legacy := len(self.Combine) > 0 || len(self.ZkDataPath) > 0 ||
+		len(self.PathMatcher) > 0 || !self.ShellCommand.IsEmpty()
+	switch {
+	case len(self.Pipelines) > 0 && legacy:
+		errs.add("pipelines", "cannot be combined with top-level `zkDataPath`, `combine`, `pathMatcher` or `shellCommand`")
+	case len(self.Pipelines) == 0 && len(self.Combine) == 0:
+		errs.add("pipelines", "at least one pipeline (or `combine` entry) is required")
+	}
+	if len(self.Pipelines) == 0 {
+		if len(self.ZkDataPath) == 0 && len(self.Combine) > 0 {
+			errs.add("zkDataPath", "at least one path is required")
+		}
+		validatePaths(&errs, "zkDataPath", self.ZkDataPath)
+		validateMatcher(&errs, "pathMatcher", self.PathMatcher)
+		validateCommand(&errs, "shellCommand", self.ShellCommand)
+		for i, combine := range self.Combine {
+			if parts := strings.Split(combine, "#"); len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+				errs.add(fmt.Sprintf("combine[%d]", i), "must have the form `template#target`")
+			}
+		}
+	}
+	if exec := self.Exec; exec != nil {
+		for _, field := range []struct{ name, signal string }{
+			{"exec.reloadSignal", exec.ReloadSignal},
+			{"exec.killSignal", exec.KillSignal},
+		} {
+			if _, err := parseSignal(field.signal); len(field.signal) > 0 && err != nil {
+				errs.add(field.name, "%v", err)
+			}
+		}
+		if exec.KillTimeout < 0 {
+			errs.add("exec.killTimeout", "must not be negative")
+		}
+		if command := exec.Command; command.Timeout != 0 || command.MaxAttempts != 0 || command.Backoff != 0 || command.MaxBackoff != 0 {
+			errs.add("exec.command", "takes no timeout, attempts or backoff, the child runs until it exits")
+		}
+	}
+	if cache := self.Cache; cache != nil {
+		if len(cache.Path) == 0 {
+			errs.add("cache.path", "must not be empty")
+		}
+		if cache.Timeout < 0 {
+			errs.add("cache.timeout", "must not be negative")
+		}
+	}
+	if admin := self.Admin; admin != nil {
+		if listen := strings.TrimPrefix(admin.Listen, "unix:"); len(listen) == 0 {
+			errs.add("admin.listen", "must not be empty")
+		} else if !strings.HasPrefix(admin.Listen, "unix:") {
+			if _, _, err := net.SplitHostPort(listen); err != nil {
+				errs.add("admin.listen", "%v", err)
+			}
+		}
+	}
+	groups := make(map[string]int)
+	for i, group := range self.Groups {
+		field := fmt.Sprintf("groups[%d]", i)
+		if len(group.Name) == 0 {
+			errs.add(field+".name", "must not be empty")
+		} else if _, ok := groups[group.Name]; ok {
+			errs.add(field+".name", "duplicate group name `%s`", group.Name)
+		} else {
+			groups[group.Name] = 0
+		}
+		validateWait(&errs, field+".wait", group.Wait)
+		validateCommand(&errs, field+".checkCommand", group.CheckCommand)
+		validateCommand(&errs, field+".shellCommand", group.ShellCommand)
+		validateSignal(&errs, field, group.Signal, group.ShellCommand)
+	}
+	names := make(map[string]bool)
+	for i, pipeline := range self.Pipelines {
+		field := fmt.Sprintf("pipelines[%d]", i)
+		if len(pipeline.Name) > 0 {
+			if names[pipeline.Name] {
+				errs.add(field+".name", "duplicate pipeline name `%s`", pipeline.Name)
+			}
+			names[pipeline.Name] = true
+		}
+		if len(pipeline.ZkDataPath) == 0 {
+			errs.add(field+".zkDataPath", "at least one path is required")
+		}
+		validatePaths(&errs, field+".zkDataPath", pipeline.ZkDataPath)
+		validateMatcher(&errs, field+".pathMatcher", pipeline.PathMatcher)
+		if len(pipeline.Template) == 0 {
+			errs.add(field+".template", "must not be empty")
+		}
+		if len(pipeline.Target) == 0 {
+			errs.add(field+".target", "must not be empty")
+		}
+		if fanOut := pipeline.FanOut; fanOut != nil {
+			covered := false
+			for _, root := range pipeline.ZkDataPath {
+				covered = covered || isUnderRoot(fanOut.Path, root)
+			}
+			if !strings.HasPrefix(fanOut.Path, "/") {
+				errs.add(field+".fanOut.path", "`%s` must be an absolute zookeeper path", fanOut.Path)
+			} else if !covered {
+				errs.add(field+".fanOut.path", "`%s` is not under any `zkDataPath` of the pipeline", fanOut.Path)
+			}
+			if _, err := template.New("target").Funcs(templateFuncs(nil, nil, false, nil)).Parse(pipeline.Target); err != nil {
+				errs.add(field+".target", "invalid target template: %v", err)
+			}
+		}
+		if _, ok := codecs[pipeline.Codec]; len(pipeline.Codec) > 0 && !ok {
+			errs.add(field+".codec", "unknown codec `%s`", pipeline.Codec)
+		}
+		for j, rule := range pipeline.Codecs {
+			ruleField := fmt.Sprintf("%s.codecs[%d]", field, j)
+			if _, ok := codecs[rule.Codec]; !ok {
+				errs.add(ruleField+".codec", "unknown codec `%s`", rule.Codec)
+			}
+			validateMatcher(&errs, ruleField+".pattern", rule.Pattern)
+		}
+		validateWait(&errs, field+".wait", pipeline.Wait)
+		validateCommand(&errs, field+".checkCommand", pipeline.CheckCommand)
+		validateCommand(&errs, field+".shellCommand", pipeline.ShellCommand)
+		validateSignal(&errs, field, pipeline.Signal, pipeline.ShellCommand)
+		if len(pipeline.Group) > 0 {
+			if members, ok := groups[pipeline.Group]; !ok {
+				errs.add(field+".group", "unknown group `%s`", pipeline.Group)
+			} else {
+				groups[pipeline.Group] = members + 1
+			}
+			if !pipeline.ShellCommand.IsEmpty() {
+				errs.add(field+".shellCommand", "must be empty, the `shellCommand` of group `%s` runs instead", pipeline.Group)
+			}
+			if pipeline.Signal != nil {
+				errs.add(field+".signal", "must not be set, the group `%s` reloads its members", pipeline.Group)
+			}
+			if pipeline.Wait != (WaitConfig{}) {
+				errs.add(field+".wait", "must not be set, the `wait` of group `%s` applies", pipeline.Group)
+			}
+		}
+		if pipeline.FileMode&^FileMode(os.ModePerm) != 0 {
+			errs.add(field+".fileMode", "only permission bits are allowed")
+		}
+		if pipeline.Uid != nil && *pipeline.Uid < 0 {
+			errs.add(field+".uid", "must not be negative")
+		}
+		if pipeline.Gid != nil && *pipeline.Gid < 0 {
+			errs.add(field+".gid", "must not be negative")
+		}
+	}
+	for i, group := range self.Groups {
+		if members, ok := groups[group.Name]; ok && members == 0 {
+			errs.add(fmt.Sprintf("groups[%d]", i), "group `%s` has no pipeline", group.Name)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func validatePaths(errs *ConfigErrors, field string, paths []string) {
+	for i, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			errs.add(fmt.Sprintf("%s[%d]", field, i), "`%s` must be an absolute zookeeper path", p)
+		}
+	}
+}
+
+func validateWait(errs *ConfigErrors, field string, wait WaitConfig) {
+	if wait.Min < 0 {
+		errs.add(field+".min", "must not be negative")
+	}
+	if wait.Max != 0 && wait.Max < wait.Min {
+		errs.add(field+".max", "must not be less than `wait.min`")
+	}
+}
+
+func validateCommand(errs *ConfigErrors, field string, command CommandConfig) {
+	if len(command.Argv) > 0 && len(command.Argv[0]) == 0 {
+		errs.add(field, "the program must not be empty")
+	}
+	if command.Timeout < 0 {
+		errs.add(field+".timeout", "must not be negative")
+	}
+	if command.MaxAttempts < 0 {
+		errs.add(field+".maxAttempts", "must not be negative")
+	}
+	if command.Backoff < 0 {
+		errs.add(field+".backoff", "must not be negative")
+	}
+	if command.MaxBackoff != 0 && command.MaxBackoff < command.Backoff {
+		errs.add(field+".maxBackoff", "must not be less than `backoff`")
+	}
+}
+
+func validateSignal(errs *ConfigErrors, field string, signal *SignalConfig, command CommandConfig) {
+	if signal == nil {
+		return
+	}
+	if !command.IsEmpty() {
+		errs.add(field+".signal", "cannot be combined with `shellCommand`")
+	}
+	if len(signal.PidFile) == 0 && len(signal.Process) == 0 {
+		errs.add(field+".signal", "`pidFile` or `process` is required")
+	}
+	if len(signal.Process) > 0 && !processLookupSupported {
+		errs.add(field+".signal.process", "looking up a process by name is only supported on Linux")
+	}
+	if len(signal.Signal) > 0 {
+		if _, err := parseSignal(signal.Signal); err != nil {
+			errs.add(field+".signal.signal", "%v", err)
+		}
+	}
+}
+
+func validateMatcher(errs *ConfigErrors, field string, matcher string) {
+	if len(matcher) == 0 {
+		return
+	}
+	if _, err := regexp.Compile(matcher); err != nil {
+		errs.add(field, "invalid regular expression: %v", err)
+	}
+}
+
+// normalize fills in defaults and converts the legacy form into pipelines.
+func (self *Config) normalize() {
+	if self.SessionTimeout == 0 {
+		self.SessionTimeout = Duration(defaultSessionTimeout)
+	}
+	if len(self.StateDir) == 0 {
+		self.StateDir = defaultStateDir()
+	}
+	if len(self.NoAuthPolicy) == 0 {
+		self.NoAuthPolicy = NoAuthFail
+	}
+	auths := make([]AuthConfig, len(self.Auth))
+	for i, auth := range self.Auth {
+		if len(auth.Scheme) == 0 {
+			auth.Scheme = defaultAuthScheme
+		}
+		auths[i] = auth
+	}
+	self.Auth = auths
+	if self.Cache != nil && self.Cache.Timeout == 0 {
+		cache := *self.Cache
+		cache.Timeout = Duration(defaultCacheTimeout)
+		self.Cache = &cache
+	}
+	if len(self.Pipelines) == 0 {
+		for i, combine := range self.Combine {
+			tmplAndTarget := strings.Split(combine, "#")
+			self.Pipelines = append(self.Pipelines, PipelineConfig{
+				Name:         fmt.Sprintf("combine-%d", i),
+				ZkDataPath:   self.ZkDataPath,
+				PathMatcher:  self.PathMatcher,
+				Template:     tmplAndTarget[0],
+				Target:       tmplAndTarget[1],
+				ShellCommand: self.ShellCommand,
+			})
+		}
+		self.ZkDataPath, self.Combine = nil, nil
+		self.PathMatcher, self.ShellCommand = "", CommandConfig{}
+	}
+	for i := range self.Pipelines {
+		if len(self.Pipelines[i].Name) == 0 {
+			self.Pipelines[i].Name = fmt.Sprintf("pipeline-%d", i)
+		}
+	}
+}
+
+// StringList accepts either a single string or a list of strings.
+type StringList []string
+
+func (self *StringList) set(val interface{}) error {
+	switch v := val.(type) {
+	case nil:
+		*self = nil
+	case string:
+		*self = StringList{v}
+	case []interface{}:
+		list := make(StringList, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("expected a string, got %T", item)
+			}
+			list = append(list, s)
+		}
+		*self = list
+	default:
+		return fmt.Errorf("expected a string or a list of strings, got %T", val)
+	}
+	return nil
+}
+
+func (self *StringList) UnmarshalJSON(data []byte) error {
+	var val interface{}
+	if err := json.Unmarshal(data, &val); err != nil {
+		return err
+	}
+	return self.set(val)
+}
+
+func (self *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val interface{}
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+	return self.set(val)
+}
+
+func (self *StringList) UnmarshalTOML(val interface{}) error {
+	return self.set(val)
+}
+
+// CommandConfig accepts a command line run through the system shell, a list
+// of arguments executed without shell, or an object with the command under
+// `command` and the `timeout`, `maxAttempts`, `backoff` (1s by default) and
+// `maxBackoff` (30s by default) of its retries.
+type CommandConfig struct {
+	Shell       string
+	Argv        []string
+	Timeout     Duration
+	MaxAttempts int
+	Backoff     Duration
+	MaxBackoff  Duration
+}
+
+func (self *CommandConfig) IsEmpty() bool {
+	return len(self.Shell) == 0 && len(self.Argv) == 0
+}
+
+func (self *CommandConfig) set(val interface{}) error {
+	*self = CommandConfig{}
+	switch v := val.(type) {
+	case nil:
+	case string:
+		self.Shell = v
+	case []interface{}:
+		var argv StringList
+		if err := argv.set(v); err != nil {
+			return err
+		}
+		if len(argv) == 0 {
+			return errors.New("expected at least one argument")
+		}
+		self.Argv = argv
+	case map[interface{}]interface{}:
+		fields := make(map[string]interface{}, len(v))
+		for key, field := range v {
+			fields[fmt.Sprint(key)] = field
+		}
+		return self.setFields(fields)
+	case map[string]interface{}:
+		return self.setFields(v)
+	default:
+		return fmt.Errorf("expected a command line, a list of arguments or an object, got %T", val)
+	}
+	return nil
+}
+
+func (self *CommandConfig) setFields(fields map[string]interface{}) error {
+	for key, val := range fields {
+		var err error
+		switch key {
+		case "command":
+			switch val.(type) {
+			case string, []interface{}:
+				var command CommandConfig
+				err = command.set(val)
+				self.Shell, self.Argv = command.Shell, command.Argv
+			default:
+				err = fmt.Errorf("expected a command line or a list of arguments, got %T", val)
+			}
+		case "timeout":
+			err = self.Timeout.set(val)
+		case "backoff":
+			err = self.Backoff.set(val)
+		case "maxBackoff":
+			err = self.MaxBackoff.set(val)
+		case "maxAttempts":
+			switch n := val.(type) {
+			case int:
+				self.MaxAttempts = n
+			case int64:
+				self.MaxAttempts = int(n)
+			case float64:
+				if n != math.Trunc(n) {
+					err = fmt.Errorf("expected an integer, got %v", n)
+				}
+				self.MaxAttempts = int(n)
+			default:
+				err = fmt.Errorf("expected a number, got %T", val)
+			}
+		default:
+			err = errors.New("unknown key")
+		}
+		if err != nil {
+			return fmt.Errorf("`%s`: %v", key, err)
+		}
+	}
+	if self.IsEmpty() {
+		return errors.New("`command` is required")
+	}
+	return nil
+}
+
+func (self *CommandConfig) UnmarshalJSON(data []byte) error {
+	var val interface{}
+	if err := json.Unmarshal(data, &val); err != nil {
+		return err
+	}
+	return self.set(val)
+}
+
+func (self *CommandConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val interface{}
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+	return self.set(val)
+}
+
+func (self *CommandConfig) UnmarshalTOML(val interface{}) error {
+	return self.set(val)
+}
+
+// FileMode accepts an octal permission string such as "0640". Numbers are
+// refused: `640` would be read as decimal by JSON and TOML, and as octal by
+// YAML when written `0640`.
+type FileMode os.FileMode
+
+func (self *FileMode) set(val interface{}) error {
+	switch v := val.(type) {
+	case string:
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid octal file mode `%s`", v)
+		}
+		*self = FileMode(mode)
+	case int, int64, float64:
+		return fmt.Errorf("expected an octal file mode string such as \"0%v\", got the number %v", v, v)
+	default:
+		return errors.New("expected an octal file mode string")
+	}
+	return nil
+}
+
+func (self *FileMode) UnmarshalJSON(data []byte) error {
+	var val interface{}
+	if err := json.Unmarshal(data, &val); err != nil {
+		return err
+	}
+	return self.set(val)
+}
+
+func (self *FileMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val interface{}
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+	return self.set(val)
+}
+
+func (self *FileMode) UnmarshalTOML(val interface{}) error {
+	return self.set(val)
+}
+
+// Duration accepts a Go duration string such as "1.5s", or a number of seconds.
+type Duration time.Duration
+
+func (self Duration) String() string {
+	return time.Duration(self).String()
+}
+
+func (self *Duration) set(val interface{}) error {
+	switch v := val.(type) {
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*self = Duration(d)
+	case int:
+		*self = Duration(time.Duration(v) * time.Second)
+	case int64:
+		*self = Duration(time.Duration(v) * time.Second)
+	case float64:
+		*self = Duration(v * float64(time.Second))
+	default:
+		return errors.New("expected a duration string or a number of seconds")
+	}
+	return nil
+}
+
+func (self *Duration) UnmarshalJSON(data []byte) error {
+	var val interface{}
+	if err := json.Unmarshal(data, &val); err != nil {
+		return err
+	}
+	return self.set(val)
+}
+
+func (self *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val interface{}
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+	return self.set(val)
+}
+
+func (self *Duration) UnmarshalTOML(val interface{}) error {
+	return self.set(val)
+}
+
+func (self Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(self.String())
+}
@@ -0,0 +1,178 @@
+package ZkAgent
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(config *Config)
+		fields []string
+	}{
+		{
+			name:   "valid",
+			modify: func(config *Config) {},
+		},
+		{
+			name: "legacy form",
+			modify: func(config *Config) {
+				config.Pipelines = nil
+				config.ZkDataPath = StringList{"/app"}
+				config.Combine = StringList{"app.tmpl#app.conf", "broken", "app.tmpl#", "#app.conf"}
+			},
+			fields: []string{"combine[1]", "combine[2]", "combine[3]"},
+		},
+		{
+			name: "legacy and pipelines",
+			modify: func(config *Config) {
+				config.ZkDataPath = StringList{"/app"}
+			},
+			fields: []string{"pipelines"},
+		},
+		{
+			name: "no server",
+			modify: func(config *Config) {
+				config.ZkServer = nil
+			},
+			fields: []string{"zkServer"},
+		},
+		{
+			name: "chroot before a server",
+			modify: func(config *Config) {
+				config.ZkServer = StringList{"h1:2181/app,h2:2181"}
+			},
+			fields: []string{"zkServer"},
+		},
+		{
+			name: "pipeline fields",
+			modify: func(config *Config) {
+				config.Pipelines = append(config.Pipelines, PipelineConfig{
+					Name:       "app",
+					ZkDataPath: StringList{"relative"},
+					Codec:      "xml",
+					Wait:       WaitConfig{Min: Duration(time.Second), Max: Duration(time.Millisecond)},
+				})
+			},
+			fields: []string{
+				"pipelines[1].name",
+				"pipelines[1].zkDataPath[0]",
+				"pipelines[1].template",
+				"pipelines[1].target",
+				"pipelines[1].codec",
+				"pipelines[1].wait.max",
+			},
+		},
+		{
+			name: "fan-out outside of the roots",
+			modify: func(config *Config) {
+				config.Pipelines[0].FanOut = &FanOutConfig{Path: "/other"}
+			},
+			fields: []string{"pipelines[0].fanOut.path"},
+		},
+		{
+			name: "signal and command",
+			modify: func(config *Config) {
+				config.Pipelines[0].ShellCommand = CommandConfig{Shell: "reload"}
+				config.Pipelines[0].Signal = &SignalConfig{}
+			},
+			fields: []string{"pipelines[0].signal", "pipelines[0].signal"},
+		},
+		{
+			name: "group members",
+			modify: func(config *Config) {
+				config.Groups = []GroupConfig{{Name: "web"}, {Name: "web"}, {Name: "empty"}}
+				config.Pipelines[0].Group = "web"
+				config.Pipelines[0].ShellCommand = CommandConfig{Shell: "reload"}
+				config.Pipelines = append(config.Pipelines, PipelineConfig{
+					Name:       "other",
+					Group:      "missing",
+					ZkDataPath: StringList{"/app"},
+					Template:   "app.tmpl",
+					Target:     "other.conf",
+				})
+			},
+			fields: []string{
+				"groups[1].name",
+				"pipelines[0].shellCommand",
+				"pipelines[1].group",
+				"groups[2]",
+			},
+		},
+		{
+			name: "auth sources",
+			modify: func(config *Config) {
+				config.Auth = []AuthConfig{{Credentials: "u:p", CredentialsEnv: "ZK_AUTH"}, {}}
+				config.NoAuthPolicy = "ignore"
+			},
+			fields: []string{"auth[0]", "auth[1]", "noAuthPolicy"},
+		},
+		{
+			name: "exec command retries",
+			modify: func(config *Config) {
+				config.Exec = &ExecConfig{Command: CommandConfig{Argv: []string{"nginx"}, MaxAttempts: 2}}
+			},
+			fields: []string{"exec.command"},
+		},
+	}
+	for _, test := range tests {
+		config := validConfig()
+		test.modify(&config)
+		var fields []string
+		for _, err := range config.Validate() {
+			fields = append(fields, err.Field)
+		}
+		if !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%s: errors on %v, want %v", test.name, fields, test.fields)
+		}
+	}
+}
+
+func TestLoadConfigValueError(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"app.json": `{"zkServer": "h:2181", "pipelines": [{"name": "a", "zkDataPath": "/a", "template": "t", "target": "o", "fileMode": "999"}]}`,
+		"app.yaml": "zkServer: h:2181\npipelines:\n  - name: a\n    zkDataPath: /a\n    template: t\n    target: o\n    fileMode: \"999\"\n",
+		"app.toml": "zkServer = \"h:2181\"\n[[pipelines]]\nname = \"a\"\nzkDataPath = \"/a\"\ntemplate = \"t\"\ntarget = \"o\"\nfileMode = \"999\"\n",
+	} {
+		_, err := LoadConfig(writeFile(t, dir, name, content))
+		if err == nil || !strings.Contains(err.Error(), "`pipelines[0].fileMode`: invalid octal file mode `999`") {
+			t.Errorf("%s: error %v, want the field of the file mode", filepath.Ext(name), err)
+		}
+	}
+}
+
+func TestLoadConfigNumbers(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{
+			name:    "fraction.json",
+			content: `{"zkServer": "h:2181", "pipelines": [{"name": "a", "zkDataPath": "/a", "template": "t", "target": "o", "shellCommand": {"command": "r", "maxAttempts": 2.7}}]}`,
+			err:     "`pipelines[0].shellCommand`: `maxAttempts`: expected an integer, got 2.7",
+		},
+		{
+			name:    "mode.json",
+			content: `{"zkServer": "h:2181", "pipelines": [{"name": "a", "zkDataPath": "/a", "template": "t", "target": "o", "fileMode": 644}]}`,
+			err:     "`pipelines[0].fileMode`: expected an octal file mode string",
+		},
+		{
+			name:    "mode.yaml",
+			content: "zkServer: h:2181\npipelines:\n  - name: a\n    zkDataPath: /a\n    template: t\n    target: o\n    fileMode: 0644\n",
+			err:     "`pipelines[0].fileMode`: expected an octal file mode string",
+		},
+	}
+	for _, test := range tests {
+		_, err := LoadConfig(writeFile(t, dir, test.name, test.content))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
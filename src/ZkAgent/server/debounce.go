@@ -0,0 +1,99 @@
+package ZkAgent
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultMaxWaitFactor sets Max, when unset, to that many times Min, so that
+// a steady stream of changes does not postpone the reload forever.
+const defaultMaxWaitFactor = 4
+
+// WaitOptions controls how changes are coalesced before a pipeline, or a
+// group, reloads.
+// A reload happens once no change has been seen for Min, but no later than
+// Max (4 times Min by default) after the first pending change. A zero Min
+// reloads on every change.
+type WaitOptions struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// dueReload is a batch of coalesced changes ready to be applied to a unit.
+type dueReload struct {
+	unit  *reloadUnit
+	paths []string
+}
+
+// debouncer collects changed paths for one reload unit and delivers them as a
+// single dueReload once the wait window has elapsed.
+type debouncer struct {
+	unit *reloadUnit
+	due  chan<- dueReload
+	done <-chan struct{}
+
+	mu    sync.Mutex
+	paths []string
+	seen  map[string]bool
+	first time.Time
+	timer *time.Timer
+}
+
+func newDebouncer(unit *reloadUnit, due chan<- dueReload, done <-chan struct{}) *debouncer {
+	return &debouncer{
+		unit: unit,
+		due:  due,
+		done: done,
+		seen: make(map[string]bool),
+	}
+}
+
+func (self *debouncer) add(nodePath string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	now := time.Now()
+	if len(self.paths) == 0 {
+		self.first = now
+	}
+	if !self.seen[nodePath] {
+		self.seen[nodePath] = true
+		self.paths = append(self.paths, nodePath)
+	}
+	wait := self.unit.wait
+	if wait.Max <= 0 {
+		wait.Max = defaultMaxWaitFactor * wait.Min
+	}
+	delay := wait.Min
+	if remaining := self.first.Add(wait.Max).Sub(now); remaining < delay {
+		delay = remaining
+	}
+	if self.timer != nil {
+		self.timer.Stop()
+	}
+	self.timer = time.AfterFunc(delay, self.fire)
+}
+
+func (self *debouncer) fire() {
+	self.mu.Lock()
+	paths := self.paths
+	self.paths = nil
+	self.seen = make(map[string]bool)
+	self.timer = nil
+	self.mu.Unlock()
+	if len(paths) == 0 {
+		return
+	}
+	select {
+	case self.due <- dueReload{unit: self.unit, paths: paths}:
+	case <-self.done:
+	}
+}
+
+func (self *debouncer) stop() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.timer != nil {
+		self.timer.Stop()
+		self.timer = nil
+	}
+}
@@ -0,0 +1,84 @@
+package ZkAgent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestDebouncer(wait WaitOptions) (*debouncer, chan dueReload, chan struct{}) {
+	due := make(chan dueReload, 1)
+	done := make(chan struct{})
+	unit := &reloadUnit{name: "app", wait: wait}
+	return newDebouncer(unit, due, done), due, done
+}
+
+func TestDebouncerCoalesces(t *testing.T) {
+	debouncer, due, done := newTestDebouncer(WaitOptions{Min: 50 * time.Millisecond, Max: time.Second})
+	defer close(done)
+	for _, nodePath := range []string{"/app/a", "/app/b", "/app/a"} {
+		debouncer.add(nodePath)
+	}
+	select {
+	case reload := <-due:
+		if want := []string{"/app/a", "/app/b"}; !reflect.DeepEqual(reload.paths, want) {
+			t.Errorf("paths = %v, want %v", reload.paths, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no reload")
+	}
+	select {
+	case reload := <-due:
+		t.Errorf("second reload %v", reload.paths)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDebouncerMaxWait(t *testing.T) {
+	tests := []struct {
+		name string
+		wait WaitOptions
+		// within is when the reload must have happened despite the stream
+		// of changes
+		within time.Duration
+	}{
+		{"explicit max", WaitOptions{Min: 100 * time.Millisecond, Max: 200 * time.Millisecond}, 400 * time.Millisecond},
+		{"default max", WaitOptions{Min: 50 * time.Millisecond}, 400 * time.Millisecond},
+	}
+	for _, test := range tests {
+		debouncer, due, done := newTestDebouncer(test.wait)
+		start := time.Now()
+		ticker := time.NewTicker(test.wait.Min / 4)
+		deadline := time.After(2 * time.Second)
+	loop:
+		for {
+			select {
+			case <-ticker.C:
+				debouncer.add("/app/a")
+			case <-due:
+				if elapsed := time.Since(start); elapsed > test.within {
+					t.Errorf("%s: reload after %v, want within %v", test.name, elapsed, test.within)
+				}
+				break loop
+			case <-deadline:
+				t.Errorf("%s: changes postponed the reload forever", test.name)
+				break loop
+			}
+		}
+		ticker.Stop()
+		debouncer.stop()
+		close(done)
+	}
+}
+
+func TestDebouncerStop(t *testing.T) {
+	debouncer, due, done := newTestDebouncer(WaitOptions{Min: 20 * time.Millisecond})
+	defer close(done)
+	debouncer.add("/app/a")
+	debouncer.stop()
+	select {
+	case reload := <-due:
+		t.Errorf("reload %v after stop", reload.paths)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,220 @@
+package ZkAgent
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// Dependency is a zookeeper path read by the templates of a pipeline. A change
+// of the node, or of its parent's children, concerns it; a change anywhere
+// below it as well when Subtree is set.
+type Dependency struct {
+	Path    string
+	Subtree bool
+}
+
+// Matches reports whether a change of nodePath may alter what was read.
+func (self Dependency) Matches(nodePath string) bool {
+	if nodePath == self.Path || nodePath == path.Dir(self.Path) {
+		return true
+	}
+	return self.Subtree && isUnderRoot(nodePath, self.Path)
+}
+
+// analyzeDependencies walks the parse trees of the pipeline templates and
+// collects the paths passed as literals to the node helpers: `value` and
+// `exists` read one node, `children`, `tree`, `node`, `root` and `roots` a
+// subtree, and `dat`/`index` on the snapshot the node of their first key.
+// A fan-out pipeline depends on the subtree of its fan-out path; nodes its
+// templates reach above it through `.Parent` are not tracked. Whenever a path
+// is not a literal, or the snapshot is used in any other way, the pipeline
+// falls back to depending on all its roots.
+func analyzeDependencies(pipeline *Pipeline) []Dependency {
+	fallback := make([]Dependency, 0, len(pipeline.Roots))
+	for _, root := range pipeline.Roots {
+		fallback = append(fallback, Dependency{Path: root, Subtree: true})
+	}
+	analyzer := &depAnalyzer{
+		roots:    pipeline.Roots,
+		deps:     make(map[Dependency]bool),
+		snapshot: pipeline.FanOut == nil,
+	}
+	funcs := templateFuncs(nil, nil, false, nil)
+	tmpl, err := parseTemplate(pipeline.Template, path.Base(pipeline.Template), funcs, false)
+	if err != nil {
+		return fallback
+	}
+	analyzer.template(tmpl)
+	if pipeline.FanOut != nil {
+		targetTmpl, err := template.New("target").Funcs(funcs).Parse(pipeline.Target)
+		if err != nil {
+			return fallback
+		}
+		analyzer.template(targetTmpl)
+		analyzer.add(pipeline.FanOut.Path, true)
+	}
+	if analyzer.dynamic {
+		return fallback
+	}
+	deps := make([]Dependency, 0, len(analyzer.deps))
+	for dep := range analyzer.deps {
+		deps = append(deps, dep)
+	}
+	sort.Slice(deps, func(i, j int) bool { return deps[i].Path < deps[j].Path })
+	return deps
+}
+
+type depAnalyzer struct {
+	roots []string
+	deps  map[Dependency]bool
+	// snapshot is whether the data of the template is the Snapshot; fan-out
+	// templates receive a TreeNode below the fan-out path instead.
+	snapshot bool
+	dynamic  bool
+}
+
+func (self *depAnalyzer) template(tmpl *template.Template) {
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			self.node(t.Tree.Root, true)
+		}
+	}
+}
+
+func (self *depAnalyzer) add(nodePath string, subtree bool) {
+	if !strings.HasPrefix(nodePath, "/") {
+		if len(self.roots) == 0 {
+			self.dynamic = true
+			return
+		}
+		nodePath = path.Join(self.roots[0], nodePath)
+	}
+	self.deps[Dependency{Path: path.Clean(nodePath), Subtree: subtree}] = true
+}
+
+// node visits a node of a parse tree. dot is whether `.` is the template data
+// there, rather than a value bound by range or with.
+func (self *depAnalyzer) node(node parse.Node, dot bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			self.node(child, dot)
+		}
+	case *parse.ActionNode:
+		self.pipe(n.Pipe, dot)
+	case *parse.IfNode:
+		self.pipe(n.Pipe, dot)
+		self.node(n.List, dot)
+		self.node(n.ElseList, dot)
+	case *parse.RangeNode:
+		self.pipe(n.Pipe, dot)
+		self.node(n.List, false)
+		self.node(n.ElseList, dot)
+	case *parse.WithNode:
+		self.pipe(n.Pipe, dot)
+		self.node(n.List, false)
+		self.node(n.ElseList, dot)
+	case *parse.TemplateNode:
+		self.pipe(n.Pipe, dot)
+	}
+}
+
+func (self *depAnalyzer) pipe(pipe *parse.PipeNode, dot bool) {
+	if pipe == nil {
+		return
+	}
+	for _, cmd := range pipe.Cmds {
+		self.command(cmd, dot)
+	}
+}
+
+func (self *depAnalyzer) command(cmd *parse.CommandNode, dot bool) {
+	args := cmd.Args
+	ident, ok := args[0].(*parse.IdentifierNode)
+	if !ok {
+		for _, arg := range args {
+			self.arg(arg, dot)
+		}
+		return
+	}
+	self.call(ident.Ident, args[1:], dot)
+}
+
+// call visits a call of the function name with args.
+func (self *depAnalyzer) call(name string, args []parse.Node, dot bool) {
+	rest := args
+	switch name {
+	case "value", "exists", "children", "tree", "node":
+		if len(rest) == 0 {
+			self.dynamic = true
+			return
+		}
+		nodePath, ok := rest[0].(*parse.StringNode)
+		if !ok {
+			self.dynamic = true
+			break
+		}
+		self.add(nodePath.Text, name != "value" && name != "exists")
+		rest = rest[1:]
+	case "root":
+		if len(self.roots) > 0 {
+			self.add(self.roots[0], true)
+		}
+	case "roots":
+		for _, root := range self.roots {
+			self.add(root, true)
+		}
+	case "dat", "index":
+		if len(rest) < 2 || !self.isData(rest[0], dot) {
+			break
+		}
+		key, ok := rest[1].(*parse.StringNode)
+		if !ok {
+			self.dynamic = true
+			break
+		}
+		self.add(key.Text, false)
+		rest = rest[2:]
+	}
+	for _, arg := range rest {
+		self.arg(arg, dot)
+	}
+}
+
+// isData reports whether arg is the template data itself.
+func (self *depAnalyzer) isData(arg parse.Node, dot bool) bool {
+	switch n := arg.(type) {
+	case *parse.DotNode:
+		return self.snapshot && dot
+	case *parse.VariableNode:
+		return self.snapshot && len(n.Ident) == 1 && n.Ident[0] == "$"
+	}
+	return false
+}
+
+// arg visits an argument outside of the node helpers. Any use of the snapshot
+// there could read any node.
+func (self *depAnalyzer) arg(arg parse.Node, dot bool) {
+	switch n := arg.(type) {
+	case *parse.DotNode, *parse.FieldNode:
+		if dot && self.snapshot {
+			self.dynamic = true
+		}
+	case *parse.VariableNode:
+		if n.Ident[0] == "$" && self.snapshot {
+			self.dynamic = true
+		}
+	case *parse.IdentifierNode:
+		self.call(n.Ident, nil, dot)
+	case *parse.ChainNode:
+		self.arg(n.Node, dot)
+	case *parse.PipeNode:
+		self.pipe(n, dot)
+	}
+}
@@ -0,0 +1,100 @@
+package ZkAgent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAnalyzeDependencies(t *testing.T) {
+	roots := []string{"/app", "/db"}
+	all := []Dependency{{Path: "/app", Subtree: true}, {Path: "/db", Subtree: true}}
+	tests := []struct {
+		name     string
+		template string
+		target   string
+		fanOut   string
+		want     []Dependency
+	}{
+		{
+			name:     "value and exists",
+			template: `{{ value "/app/port" }}{{ if exists "/db/host" }}db{{ end }}`,
+			want:     []Dependency{{Path: "/app/port"}, {Path: "/db/host"}},
+		},
+		{
+			name:     "children and tree",
+			template: `{{ range children "/app/servers" }}{{ .Value }}{{ end }}{{ tree "/db" }}`,
+			want:     []Dependency{{Path: "/app/servers", Subtree: true}, {Path: "/db", Subtree: true}},
+		},
+		{
+			name:     "relative path",
+			template: `{{ (node "servers").Value }}{{ value "port" }}`,
+			want:     []Dependency{{Path: "/app/port"}, {Path: "/app/servers", Subtree: true}},
+		},
+		{
+			name:     "dat on the snapshot",
+			template: `{{ dat . "/app/port" "Value" }}{{ index $ "/db/host" }}`,
+			want:     []Dependency{{Path: "/app/port"}, {Path: "/db/host"}},
+		},
+		{
+			name:     "root",
+			template: `{{ range root.Children }}{{ .Name }}{{ end }}`,
+			want:     []Dependency{{Path: "/app", Subtree: true}},
+		},
+		{
+			name:     "dynamic path",
+			template: `{{ $p := "/app/port" }}{{ value $p }}`,
+			want:     all,
+		},
+		{
+			name:     "snapshot ranged over",
+			template: `{{ range . }}{{ .Path }}{{ end }}`,
+			want:     all,
+		},
+		{
+			name:     "fan-out",
+			template: `{{ .Value }}{{ .Parent.Name }}`,
+			target:   `/etc/{{ .Name }}.conf`,
+			fanOut:   "/app/sites",
+			want:     []Dependency{{Path: "/app/sites", Subtree: true}},
+		},
+		{
+			name:     "invalid template",
+			template: `{{ value "/app/port" `,
+			want:     all,
+		},
+	}
+	for _, test := range tests {
+		pipeline := &Pipeline{
+			Name:     "test",
+			Roots:    roots,
+			Template: writeFile(t, t.TempDir(), "test.tmpl", test.template),
+			Target:   test.target,
+		}
+		if len(test.fanOut) > 0 {
+			pipeline.FanOut = &FanOutOptions{Path: test.fanOut}
+		}
+		if got := analyzeDependencies(pipeline); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDependencyMatches(t *testing.T) {
+	tests := []struct {
+		dep      Dependency
+		nodePath string
+		want     bool
+	}{
+		{Dependency{Path: "/app/port"}, "/app/port", true},
+		{Dependency{Path: "/app/port"}, "/app", true},
+		{Dependency{Path: "/app/port"}, "/app/host", false},
+		{Dependency{Path: "/app/port"}, "/app/port/x", false},
+		{Dependency{Path: "/app", Subtree: true}, "/app/a/b", true},
+		{Dependency{Path: "/app", Subtree: true}, "/apple", false},
+	}
+	for _, test := range tests {
+		if got := test.dep.Matches(test.nodePath); got != test.want {
+			t.Errorf("%+v.Matches(%s) = %v, want %v", test.dep, test.nodePath, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package ZkAgent
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// numberedLines returns the lines 1 to n, replacing the lines of changed.
+func numberedLines(n int, changed map[int]string) string {
+	var buffer strings.Builder
+	for i := 1; i <= n; i++ {
+		if line, ok := changed[i]; ok {
+			buffer.WriteString(line + "\n")
+			continue
+		}
+		fmt.Fprintf(&buffer, "%d\n", i)
+	}
+	return buffer.String()
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		previous string
+		current  string
+		want     string
+	}{
+		{
+			name:     "equal",
+			from:     "a",
+			to:       "b",
+			previous: "x\n",
+			current:  "x\n",
+			want:     "",
+		},
+		{
+			name:    "created",
+			to:      "b",
+			current: "x\ny\n",
+			want:    "--- /dev/null\n+++ b\n@@ -0,0 +1,2 @@\n+x\n+y\n",
+		},
+		{
+			name:     "removed",
+			from:     "a",
+			previous: "x\ny\n",
+			want:     "--- a\n+++ /dev/null\n@@ -1,2 +0,0 @@\n-x\n-y\n",
+		},
+		{
+			name:     "context",
+			from:     "a",
+			to:       "b",
+			previous: numberedLines(9, nil),
+			current:  numberedLines(9, map[int]string{5: "x"}),
+			want:     "--- a\n+++ b\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+x\n 6\n 7\n 8\n",
+		},
+		{
+			name:     "two hunks",
+			from:     "a",
+			to:       "b",
+			previous: numberedLines(20, nil),
+			current:  numberedLines(20, map[int]string{2: "x", 18: "y"}),
+			want: "--- a\n+++ b\n@@ -1,5 +1,5 @@\n 1\n-2\n+x\n 3\n 4\n 5\n" +
+				"@@ -15,6 +15,6 @@\n 15\n 16\n 17\n-18\n+y\n 19\n 20\n",
+		},
+		{
+			name:     "no newline at end",
+			from:     "a",
+			to:       "b",
+			previous: "x",
+			current:  "y",
+			want:     "--- a\n+++ b\n@@ -1,1 +1,1 @@\n-x\n\\ No newline at end of file\n+y\n\\ No newline at end of file\n",
+		},
+	}
+	for _, test := range tests {
+		var previous, current []byte
+		if len(test.previous) > 0 {
+			previous = []byte(test.previous)
+		}
+		if len(test.current) > 0 {
+			current = []byte(test.current)
+		}
+		if got := unifiedDiff(test.from, test.to, previous, current); got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package ZkAgent
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type AgentEventType int
+
+const (
+	// EventRendered is sent after a target was written and its command, if
+	// any, succeeded.
+	EventRendered AgentEventType = iota + 1
+	// EventRenderFailed is sent when the template could not be rendered or
+	// the target could not be written.
+	EventRenderFailed
+	// EventCheckFailed is sent when the check command rejected the staged
+	// file. The target is left untouched.
+	EventCheckFailed
+	// EventCommandFailed is sent when the reload command failed. The target
+	// has been restored to its previous content.
+	EventCommandFailed
+	// EventUnchanged is sent when the rendered content equals the target on
+	// disk, so neither the target nor the command were touched.
+	EventUnchanged
+	// EventReconnected is sent after a new session or a reconnect, once all
+	// roots were fetched again with fresh watches. Paths lists the nodes that
+	// changed meanwhile.
+	EventReconnected
+	// EventDisconnected is sent when the connection to zookeeper is lost. Err
+	// is zk.ErrSessionExpired if the session expired.
+	EventDisconnected
+)
+
+var agentEventNames = map[AgentEventType]string{
+	EventRendered:      "Rendered",
+	EventRenderFailed:  "RenderFailed",
+	EventCheckFailed:   "CheckFailed",
+	EventCommandFailed: "CommandFailed",
+	EventUnchanged:     "Unchanged",
+	EventReconnected:   "Reconnected",
+	EventDisconnected:  "Disconnected",
+}
+
+func (self AgentEventType) String() string {
+	if name := agentEventNames[self]; len(name) > 0 {
+		return name
+	}
+	return "Unknown"
+}
+
+// AgentEvent reports the outcome of an agent action on a pipeline or a group.
+type AgentEvent struct {
+	Type AgentEventType
+	Time time.Time
+	// Group is set for the actions on a group. Pipeline is then only set
+	// when the failure comes from one of its members.
+	Group    string
+	Pipeline string
+	// Paths are the zookeeper paths whose changes caused the action, empty
+	// for the initial render and the reloads asked through the admin API.
+	Paths  []string
+	Target string
+	// Initial is set for the render at startup, which precedes the child of
+	// a Supervisor.
+	Initial bool
+	// Files are the target files written or removed by the action.
+	Files []string
+	// Command is the last command run by the action, with its captured
+	// output and exit code, and the number of attempts made.
+	Command  string
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Attempts int
+	// Duration is the time the action took, CommandDuration the part of it
+	// spent in the last command, retries included.
+	Duration        time.Duration
+	CommandDuration time.Duration
+	// DryRun is set when nothing was written nor run; Diff then holds the
+	// unified diff of the files that would have been written.
+	DryRun bool
+	Diff   string
+	// Stale is set when the data was loaded from the snapshot cache because
+	// zookeeper could not be reached.
+	Stale bool
+	// Hash is the sha256 of the rendered content, PreviousHash the one of
+	// the target before the action (empty if it did not exist).
+	Hash         string
+	PreviousHash string
+	Err          error
+}
+
+func (self *AgentEvent) String() string {
+	msg := self.Type.String()
+	if self.DryRun {
+		msg += " (dry run)"
+	}
+	if self.Stale {
+		msg += " (stale)"
+	}
+	if len(self.Group) > 0 {
+		msg += " group=" + self.Group
+	}
+	if len(self.Pipeline) > 0 {
+		msg += fmt.Sprintf(" pipeline=%s target=%s", self.Pipeline, self.Target)
+	}
+	if len(self.Paths) > 0 {
+		msg += " paths=" + strings.Join(self.Paths, ",")
+	}
+	if len(self.Command) > 0 {
+		msg += fmt.Sprintf(" command=%q", self.Command)
+		if self.Attempts > 0 {
+			msg += fmt.Sprintf(" exit=%d", self.ExitCode)
+		}
+		if self.Attempts > 1 {
+			msg += fmt.Sprintf(" attempts=%d", self.Attempts)
+		}
+	}
+	if self.Err != nil {
+		msg += fmt.Sprintf(" error=%q", self.Err.Error())
+	}
+	return msg
+}
+
+// Fields returns the set attributes of the event as key/value pairs for a
+// Logger.
+func (self *AgentEvent) Fields() []interface{} {
+	var fields []interface{}
+	add := func(key string, value interface{}, set bool) {
+		if set {
+			fields = append(fields, key, value)
+		}
+	}
+	add("dryRun", true, self.DryRun)
+	add("stale", true, self.Stale)
+	add("group", self.Group, len(self.Group) > 0)
+	add("pipeline", self.Pipeline, len(self.Pipeline) > 0)
+	add("target", self.Target, len(self.Target) > 0)
+	add("paths", self.Paths, len(self.Paths) > 0)
+	add("files", self.Files, len(self.Files) > 0)
+	add("command", self.Command, len(self.Command) > 0)
+	add("exit", self.ExitCode, self.Attempts > 0)
+	add("attempts", self.Attempts, self.Attempts > 1)
+	add("duration", self.Duration, self.Duration > 0)
+	add("hash", self.Hash, len(self.Hash) > 0)
+	add("error", self.Err, self.Err != nil)
+	return fields
+}
+
+// source returns the name of the pipeline or group of the event, empty for
+// the events of the connection.
+func (self *AgentEvent) source() string {
+	if len(self.Group) > 0 {
+		return self.Group
+	}
+	return self.Pipeline
+}
+
+func newAgentEvent(eventType AgentEventType, unit *reloadUnit, changedPaths []string) *AgentEvent {
+	event := &AgentEvent{
+		Type:  eventType,
+		Time:  time.Now(),
+		Paths: changedPaths,
+	}
+	if unit.group != nil {
+		event.Group = unit.group.Name
+	} else {
+		event.Pipeline = unit.pipelines[0].Name
+		event.Target = unit.pipelines[0].Target
+	}
+	return event
+}
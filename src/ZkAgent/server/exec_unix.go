@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package ZkAgent
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// ForwardSignals are the signals a Supervisor forwards to its child.
+var ForwardSignals = []os.Signal{
+	syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT,
+	syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGWINCH,
+}
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// exitStatus returns the exit code of a process, or 128 plus the signal that
+// terminated it, as shells do.
+func exitStatus(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
@@ -0,0 +1,24 @@
+//go:build windows
+// +build windows
+
+package ZkAgent
+
+import (
+	"os"
+	"os/exec"
+)
+
+// ForwardSignals are the signals a Supervisor forwards to its child.
+var ForwardSignals = []os.Signal{os.Interrupt}
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup only kills the process itself, Windows has no process
+// groups to signal.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+func exitStatus(state *os.ProcessState) int {
+	return state.ExitCode()
+}
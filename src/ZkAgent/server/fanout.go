@@ -0,0 +1,163 @@
+package ZkAgent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// FanOutOptions renders the template once per child of Path. The pipeline
+// target is then itself a template, executed like the content template with
+// the child TreeNode as data, e.g. `sites-enabled/{{ .Name }}.conf`.
+type FanOutOptions struct {
+	Path string
+	// Manifest lists the files the pipeline created, so that only those are
+	// removed when their child disappears, and only those are overwritten.
+	Manifest string
+}
+
+// defaultManifest places the manifest in the state directory of the agent,
+// rather than among the rendered files, where a wildcard include of the
+// consumer would read it, or next to the template, which may be read-only.
+func defaultManifest(name string, stateDir string) string {
+	return filepath.Join(stateDir, name+".manifest")
+}
+
+// renderFanOut renders one output per child of the fan-out path. It returns
+// the owned files that no child renders to anymore as removals.
+func renderFanOut(pipeline *Pipeline, data Snapshot, funcs template.FuncMap) ([]output, []string, error) {
+	contentTmpl, err := parseTemplate(pipeline.Template, filepath.Base(pipeline.Template), funcs, pipeline.Strict)
+	if err != nil {
+		return nil, nil, err
+	}
+	targetTmpl := template.New("target").Funcs(funcs)
+	if pipeline.Strict {
+		targetTmpl = targetTmpl.Option("missingkey=error")
+	}
+	if targetTmpl, err = targetTmpl.Parse(pipeline.Target); err != nil {
+		return nil, nil, err
+	}
+
+	owned, err := readManifest(pipeline.FanOut.Manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	ownedSet := make(map[string]bool, len(owned))
+	for _, target := range owned {
+		ownedSet[target] = true
+	}
+
+	var outputs []output
+	var children []*TreeNode
+	if parent, ok := buildTree(data)[pipeline.FanOut.Path]; ok {
+		children = parent.Children
+	}
+	seen := make(map[string]string)
+	for _, child := range children {
+		target, err := executeTemplate(targetTmpl, child)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Render target of `%s` failed, cause by: %+v", child.Path, err)
+		}
+		targetPath := filepath.Clean(strings.TrimSpace(string(target)))
+		if other, ok := seen[targetPath]; ok {
+			return nil, nil, fmt.Errorf("Nodes `%s` and `%s` both render to `%s`.", other, child.Path, targetPath)
+		}
+		seen[targetPath] = child.Path
+		if !ownedSet[targetPath] {
+			if _, err := os.Lstat(targetPath); err == nil {
+				return nil, nil, fmt.Errorf("Target `%s` of `%s` exists and is not owned by the pipeline, remove it or list it in `%s`.", targetPath, child.Path, pipeline.FanOut.Manifest)
+			}
+		}
+		content, err := executeTemplate(contentTmpl, child)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Execute template `%s` for `%s` failed, cause by: %+v", pipeline.Template, child.Path, err)
+		}
+		outputs = append(outputs, output{target: targetPath, data: content})
+	}
+
+	var removals []string
+	for _, target := range owned {
+		if _, ok := seen[target]; !ok {
+			removals = append(removals, target)
+		}
+	}
+	return outputs, removals, nil
+}
+
+func readManifest(manifestPath string) ([]string, error) {
+	data, existed, err := readPrevious(manifestPath)
+	if err != nil || !existed {
+		return nil, err
+	}
+	var owned []string
+	if err := json.Unmarshal(data, &owned); err != nil {
+		return nil, fmt.Errorf("Invalid manifest `%s`, cause by: %+v", manifestPath, err)
+	}
+	return owned, nil
+}
+
+// claimManifest adds the files of outputs to the files owned by the pipeline,
+// before they are written, so that a file created by the pipeline is never
+// taken for a foreign one. It returns the files owned before, nil when there
+// was no manifest, for releaseManifest.
+func claimManifest(manifestPath string, outputs []output) ([]string, error) {
+	previous, err := readManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	owned := append([]string(nil), previous...)
+	for _, out := range outputs {
+		owned = append(owned, out.target)
+	}
+	return previous, writeManifest(manifestPath, owned)
+}
+
+// releaseManifest puts back the files owned before claimManifest, when the
+// claimed files were not written or were restored, so that a file left by
+// someone else at one of their targets is not taken for the pipeline's.
+func releaseManifest(manifestPath string, previous []string) error {
+	if previous == nil {
+		if err := os.Remove(manifestPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return writeManifest(manifestPath, previous)
+}
+
+// updateManifest records the files of outputs as the files owned by the
+// pipeline.
+func updateManifest(manifestPath string, outputs []output) error {
+	owned := make([]string, 0, len(outputs))
+	for _, out := range outputs {
+		owned = append(owned, out.target)
+	}
+	return writeManifest(manifestPath, owned)
+}
+
+func writeManifest(manifestPath string, targets []string) error {
+	sort.Strings(targets)
+	owned := make([]string, 0, len(targets))
+	for i, target := range targets {
+		if i == 0 || target != targets[i-1] {
+			owned = append(owned, target)
+		}
+	}
+	previous, _ := readManifest(manifestPath)
+	if previous != nil && reflect.DeepEqual(previous, owned) {
+		return nil
+	}
+	data, err := json.MarshalIndent(owned, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(manifestPath), 0755); err != nil {
+		return fmt.Errorf("Create manifest directory failed, cause by: %+v", err)
+	}
+	return writeFileAtomic(manifestPath, data, FileOptions{Mode: defaultFileMode, Uid: -1, Gid: -1})
+}
@@ -0,0 +1,108 @@
+package ZkAgent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newFanOutAgent creates an agent rendering one `<child>.conf` per child of
+// /app into its directory, with the target template given.
+func newFanOutAgent(t *testing.T, target string) (*Agent, *fakeRunner, string) {
+	dir := t.TempDir()
+	tmpl := writeFile(t, dir, "app.tmpl", `value={{ .Value }}`)
+	runner := &fakeRunner{}
+	config := Config{
+		ZkServer: StringList{"127.0.0.1:2181"},
+		StateDir: dir,
+		Pipelines: []PipelineConfig{{
+			Name:         "app",
+			ZkDataPath:   StringList{"/app"},
+			Template:     tmpl,
+			Target:       filepath.Join(dir, target),
+			FanOut:       &FanOutConfig{Path: "/app"},
+			ShellCommand: CommandConfig{Shell: "reload app"},
+		}},
+	}
+	return newTestAgent(t, config, runner, testSnapshot()), runner, dir
+}
+
+func TestFanOutOwnership(t *testing.T) {
+	agent, _, dir := newFanOutAgent(t, "{{ .Name }}.conf")
+	manifest := agent.pipelines[0].FanOut.Manifest
+	if event := agent.reload(agent.units[0], nil, true, false); event.Type != EventRendered {
+		t.Fatalf("event = %v, want Rendered", event)
+	}
+	a, b := filepath.Join(dir, "a.conf"), filepath.Join(dir, "b.conf")
+	if got := readTarget(t, a) + " " + readTarget(t, b); got != "value=1 value=2" {
+		t.Errorf("targets = %q", got)
+	}
+	if owned, _ := readManifest(manifest); !reflect.DeepEqual(owned, []string{a, b}) {
+		t.Errorf("manifest = %v, want both targets", owned)
+	}
+
+	snapshot := testSnapshot()
+	delete(snapshot, "/app/b")
+	snapshot["/app"] = ZkNode{Path: "/app", Childs: []string{"a"}}
+	agent.zkData.snapshot = snapshot
+	if event := agent.reload(agent.units[0], nil, true, false); event.Type != EventRendered {
+		t.Fatalf("event = %v, want Rendered", event)
+	}
+	if got := readTarget(t, b); got != "<none>" {
+		t.Errorf("removed child left %q", got)
+	}
+	if owned, _ := readManifest(manifest); !reflect.DeepEqual(owned, []string{a}) {
+		t.Errorf("manifest = %v, want the remaining target", owned)
+	}
+}
+
+func TestFanOutRefusesForeignTarget(t *testing.T) {
+	agent, runner, dir := newFanOutAgent(t, "{{ .Name }}.conf")
+	foreign := writeFile(t, dir, "b.conf", "mine")
+	if event := agent.reload(agent.units[0], nil, true, false); event.Type != EventRenderFailed {
+		t.Fatalf("event = %v, want RenderFailed", event)
+	}
+	if got := readTarget(t, foreign); got != "mine" {
+		t.Errorf("foreign target = %q, want it untouched", got)
+	}
+	if got := readTarget(t, filepath.Join(dir, "a.conf")); got != "<none>" {
+		t.Errorf("target written despite the refusal: %q", got)
+	}
+	if commands := runner.commands(); len(commands) > 0 {
+		t.Errorf("ran %v", commands)
+	}
+}
+
+func TestFanOutRefusesCollision(t *testing.T) {
+	agent, _, dir := newFanOutAgent(t, "all.conf")
+	if event := agent.reload(agent.units[0], nil, true, false); event.Type != EventRenderFailed {
+		t.Fatalf("event = %v, want RenderFailed", event)
+	}
+	if got := readTarget(t, filepath.Join(dir, "all.conf")); got != "<none>" {
+		t.Errorf("colliding target written: %q", got)
+	}
+}
+
+func TestFanOutFailureReleasesManifest(t *testing.T) {
+	agent, runner, dir := newFanOutAgent(t, "{{ .Name }}.conf")
+	manifest := agent.pipelines[0].FanOut.Manifest
+	runner.err = errors.New("exit status 1")
+	if event := agent.reload(agent.units[0], nil, true, false); event.Type != EventCommandFailed {
+		t.Fatalf("event = %v, want CommandFailed", event)
+	}
+	if got := readTarget(t, filepath.Join(dir, "a.conf")); got != "<none>" {
+		t.Errorf("target not restored: %q", got)
+	}
+	if _, err := os.Stat(manifest); !os.IsNotExist(err) {
+		t.Errorf("manifest left after the failure: %v", err)
+	}
+
+	// a file created later at a target of the failed reload stays foreign
+	writeFile(t, dir, "a.conf", "mine")
+	runner.err = nil
+	if event := agent.reload(agent.units[0], nil, true, false); event.Type != EventRenderFailed {
+		t.Errorf("event = %v, want RenderFailed", event)
+	}
+}
@@ -0,0 +1,139 @@
+package ZkAgent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const defaultFileMode = os.FileMode(0644)
+
+// FileOptions controls how a target file is written.
+type FileOptions struct {
+	Mode os.FileMode
+	// Uid and Gid change the ownership of the written file, -1 keeps the
+	// owner of the agent process.
+	Uid int
+	Gid int
+	// Backup keeps the previous version of the target as `<target>.bak`.
+	Backup bool
+}
+
+// writeFileAtomic replaces targetPath with data so that readers observe
+// either the old or the new content, never a partially written file.
+func writeFileAtomic(targetPath string, data []byte, opts FileOptions) error {
+	stagedPath, err := stageFile(targetPath, data, opts)
+	if err != nil {
+		return err
+	}
+	if err := promoteFile(stagedPath, targetPath, opts); err != nil {
+		os.Remove(stagedPath)
+		return err
+	}
+	return nil
+}
+
+// stageFile writes data to a temporary file next to targetPath, syncs it to
+// disk and applies the permissions of opts. The caller either promotes the
+// returned path with promoteFile or removes it.
+func stageFile(targetPath string, data []byte, opts FileOptions) (string, error) {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(targetPath), "."+filepath.Base(targetPath)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := tmpFile.Name()
+	err = func() error {
+		if _, err := tmpFile.Write(data); err != nil {
+			tmpFile.Close()
+			return err
+		}
+		if err := tmpFile.Sync(); err != nil {
+			tmpFile.Close()
+			return err
+		}
+		if err := tmpFile.Close(); err != nil {
+			return err
+		}
+		mode := opts.Mode
+		if mode == 0 {
+			mode = defaultFileMode
+		}
+		if err := os.Chmod(tmpPath, mode); err != nil {
+			return err
+		}
+		if opts.Uid >= 0 || opts.Gid >= 0 {
+			return os.Chown(tmpPath, opts.Uid, opts.Gid)
+		}
+		return nil
+	}()
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+// promoteFile renames a staged file over targetPath, keeping a backup of the
+// previous version first when requested.
+func promoteFile(stagedPath string, targetPath string, opts FileOptions) error {
+	if opts.Backup {
+		if err := backupFile(targetPath, opts); err != nil {
+			return fmt.Errorf("Backup `%s` failed, cause by: %+v", targetPath, err)
+		}
+	}
+	if err := os.Rename(stagedPath, targetPath); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(targetPath))
+	return nil
+}
+
+// readPrevious returns the current content of targetPath and whether it exists.
+func readPrevious(targetPath string) ([]byte, bool, error) {
+	data, err := ioutil.ReadFile(targetPath)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// restoreFile puts back the content returned by readPrevious, removing the
+// target if it did not exist before.
+func restoreFile(targetPath string, data []byte, existed bool, opts FileOptions) error {
+	if !existed {
+		err := os.Remove(targetPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	opts.Backup = false
+	return writeFileAtomic(targetPath, data, opts)
+}
+
+func backupFile(targetPath string, opts FileOptions) error {
+	data, err := ioutil.ReadFile(targetPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	opts.Backup = false
+	return writeFileAtomic(targetPath+".bak", data, opts)
+}
+
+// syncDir flushes the directory entry of a rename to disk. It is best effort,
+// as not every platform supports syncing directories.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,374 @@
+package ZkAgent
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// templateFuncs returns the functions available to both the target templates
+// and the command templates. The node helpers are bound to data, the snapshot
+// being rendered, and to roots, the roots of the pipeline.
+//
+// Data access:
+//
+//	dat DATA KEY...        walk maps, slices and struct fields, e.g. dat . "/nginx" "Value"
+//	value PATH             value of the node at PATH
+//	exists PATH            whether a node exists at PATH
+//	children PATH          child nodes of PATH, ordered by name
+//	tree PATH              PATH and all its descendants, depth-first
+//
+// Tree view (TreeNode has Name, Path, Parent, Children, Stat, Value, Parsed,
+// and the Child NAME, Get RELPATH and Walk methods):
+//
+//	root                   the TreeNode of the first pipeline root
+//	roots                  the TreeNodes of all pipeline roots that exist
+//	node PATH              the TreeNode at PATH
+//	walk NODE              NODE and all its descendants, depth-first
+//
+// Decoding:
+//
+//	json S, yaml S, toml S decode a document into maps and lists
+//	properties S           decode a Java properties document into a map
+//	base64 S               encode S, base64Decode S decodes it
+//	toJSON V               encode V as JSON
+//
+// Lists (of strings, nodes or tree nodes; nodes are compared by name):
+//
+//	sortLex LIST, sortNatural LIST, sortSeq LIST
+//	                       sort lexically, with numbers compared by value, or by
+//	                       the sequence suffix of sequential nodes
+//	filter REGEXP LIST     keep the items whose name matches REGEXP
+//	where KEY VALUE LIST   keep the items for which `dat ITEM KEY` equals VALUE
+//
+// Strings and environment:
+//
+//	split SEP S, join SEP LIST, replace OLD NEW S, regexMatch REGEXP S
+//	default DEFAULT V      V, or DEFAULT if V is empty
+//	env NAME, hostname
+//
+// A relative PATH is resolved against the first pipeline root. In strict mode
+// a missing key or node fails the render. Otherwise the helpers return an
+// empty value and the problem is only logged.
+func templateFuncs(data Snapshot, roots []string, strict bool, logger Logger) template.FuncMap {
+	missing := func(err error) error {
+		if strict {
+			return err
+		}
+		logger.Log(LevelWarn, "Template lookup failed.", "error", err)
+		return nil
+	}
+	// resolve makes a relative path relative to the first root, like the
+	// dependency analysis does.
+	resolve := func(nodePath string) string {
+		if !strings.HasPrefix(nodePath, "/") && len(roots) > 0 {
+			return path.Join(roots[0], nodePath)
+		}
+		return path.Clean(nodePath)
+	}
+	var index map[string]*TreeNode
+	treeNode := func(nodePath string) (*TreeNode, error) {
+		if index == nil {
+			index = buildTree(data)
+		}
+		nodePath = resolve(nodePath)
+		node, ok := index[nodePath]
+		if !ok {
+			return nil, missing(fmt.Errorf("node `%s` does not exist", nodePath))
+		}
+		return node, nil
+	}
+	return template.FuncMap{
+		"dat": func(item interface{}, keys ...string) (interface{}, error) {
+			res, err := lookupKey(item, keys...)
+			if err != nil {
+				return nil, missing(err)
+			}
+			return res, nil
+		},
+		"value": func(nodePath string) (string, error) {
+			nodePath = resolve(nodePath)
+			node, ok := data[nodePath]
+			if !ok {
+				return "", missing(fmt.Errorf("node `%s` does not exist", nodePath))
+			}
+			return node.Value, nil
+		},
+		"exists": func(nodePath string) bool {
+			_, ok := data[resolve(nodePath)]
+			return ok
+		},
+		"children": func(nodePath string) ([]ZkNode, error) {
+			nodePath = resolve(nodePath)
+			if _, ok := data[nodePath]; !ok {
+				return nil, missing(fmt.Errorf("node `%s` does not exist", nodePath))
+			}
+			return data.children(nodePath), nil
+		},
+		"tree": func(nodePath string) ([]ZkNode, error) {
+			nodePath = resolve(nodePath)
+			if _, ok := data[nodePath]; !ok {
+				return nil, missing(fmt.Errorf("node `%s` does not exist", nodePath))
+			}
+			return data.walk(nodePath, nil), nil
+		},
+		"root": func() (*TreeNode, error) {
+			if len(roots) == 0 {
+				return nil, missing(fmt.Errorf("pipeline has no root"))
+			}
+			return treeNode(roots[0])
+		},
+		"roots": func() []*TreeNode {
+			var res []*TreeNode
+			for _, root := range roots {
+				if node, _ := treeNode(root); node != nil {
+					res = append(res, node)
+				}
+			}
+			return res
+		},
+		"node": treeNode,
+		"walk": func(node *TreeNode) []*TreeNode {
+			if node == nil {
+				return nil
+			}
+			return node.Walk()
+		},
+		"json":       decodeJSON,
+		"yaml":       decodeYAML,
+		"toml":       decodeTOML,
+		"properties": decodeProperties,
+		"base64": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+		"base64Decode": func(s string) (string, error) {
+			res, err := base64.StdEncoding.DecodeString(s)
+			return string(res), err
+		},
+		"toJSON": func(v interface{}) (string, error) {
+			res, err := json.Marshal(v)
+			return string(res), err
+		},
+		"sortLex": func(list interface{}) (interface{}, error) {
+			return sortList(list, func(a, b string) bool { return a < b })
+		},
+		"sortNatural": func(list interface{}) (interface{}, error) {
+			return sortList(list, naturalLess)
+		},
+		"sortSeq": func(list interface{}) (interface{}, error) {
+			return sortList(list, func(a, b string) bool { return sequenceOf(a) < sequenceOf(b) })
+		},
+		"filter": func(pattern string, list interface{}) (interface{}, error) {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, err
+			}
+			return filterList(list, func(item interface{}) bool { return re.MatchString(itemName(item)) })
+		},
+		"where": func(key string, value interface{}, list interface{}) (interface{}, error) {
+			return filterList(list, func(item interface{}) bool {
+				res, err := lookupKey(item, strings.Split(key, ".")...)
+				return err == nil && fmt.Sprint(res) == fmt.Sprint(value)
+			})
+		},
+		"split": func(sep string, s string) []string {
+			return strings.Split(s, sep)
+		},
+		"join": func(sep string, list interface{}) (string, error) {
+			names, err := listNames(list)
+			return strings.Join(names, sep), err
+		},
+		"replace": func(old string, new string, s string) string {
+			return strings.Replace(s, old, new, -1)
+		},
+		"regexMatch": regexp.MatchString,
+		"default": func(def interface{}, v interface{}) interface{} {
+			if isEmpty(v) {
+				return def
+			}
+			return v
+		},
+		"env": os.Getenv,
+		"hostname": func() (string, error) {
+			return os.Hostname()
+		},
+	}
+}
+
+// lookupKey walks keys through maps (by key), slices (by index), pointers and
+// structs (by field name), failing on the first missing key.
+func lookupKey(data interface{}, keys ...string) (res interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			res, err = nil, fmt.Errorf("key %q not found: %v", keys, r)
+		}
+	}()
+	for _, k := range keys {
+		rdata := reflect.ValueOf(data)
+		for rdata.Kind() == reflect.Ptr || rdata.Kind() == reflect.Interface {
+			rdata = rdata.Elem()
+		}
+		var next reflect.Value
+		switch rdata.Kind() {
+		case reflect.Map:
+			next = rdata.MapIndex(reflect.ValueOf(k).Convert(rdata.Type().Key()))
+		case reflect.Slice, reflect.Array:
+			idx, err := strconv.Atoi(k)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index %q: %v", k, err)
+			}
+			next = rdata.Index(idx)
+		case reflect.Struct:
+			next = rdata.FieldByName(k)
+		}
+		if !next.IsValid() {
+			return nil, fmt.Errorf("key %q not found", k)
+		}
+		data = next.Interface()
+	}
+	return data, nil
+}
+
+// children returns the child nodes of nodePath ordered by name.
+func (self Snapshot) children(nodePath string) []ZkNode {
+	node := self[nodePath]
+	names := append([]string(nil), node.Childs...)
+	sort.Strings(names)
+	res := make([]ZkNode, 0, len(names))
+	for _, name := range names {
+		if child, ok := self[path.Join(nodePath, name)]; ok {
+			res = append(res, child)
+		}
+	}
+	return res
+}
+
+// walk appends nodePath and its descendants to res, depth-first.
+func (self Snapshot) walk(nodePath string, res []ZkNode) []ZkNode {
+	node, ok := self[nodePath]
+	if !ok {
+		return res
+	}
+	res = append(res, node)
+	for _, child := range self.children(nodePath) {
+		res = self.walk(child.Path, res)
+	}
+	return res
+}
+
+func itemName(item interface{}) string {
+	switch node := item.(type) {
+	case ZkNode:
+		return path.Base(node.Path)
+	case *TreeNode:
+		return node.Name
+	}
+	return fmt.Sprint(item)
+}
+
+func listNames(list interface{}) ([]string, error) {
+	rlist := reflect.ValueOf(list)
+	if rlist.Kind() != reflect.Slice && rlist.Kind() != reflect.Array {
+		return nil, fmt.Errorf("expected a list, got %T", list)
+	}
+	names := make([]string, 0, rlist.Len())
+	for i := 0; i < rlist.Len(); i++ {
+		names = append(names, itemName(rlist.Index(i).Interface()))
+	}
+	return names, nil
+}
+
+// sortList returns a sorted copy of list, comparing items by name.
+func sortList(list interface{}, less func(a, b string) bool) (interface{}, error) {
+	rlist := reflect.ValueOf(list)
+	if rlist.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("expected a list, got %T", list)
+	}
+	res := reflect.MakeSlice(rlist.Type(), rlist.Len(), rlist.Len())
+	reflect.Copy(res, rlist)
+	sort.SliceStable(res.Interface(), func(i, j int) bool {
+		return less(itemName(res.Index(i).Interface()), itemName(res.Index(j).Interface()))
+	})
+	return res.Interface(), nil
+}
+
+func filterList(list interface{}, keep func(item interface{}) bool) (interface{}, error) {
+	rlist := reflect.ValueOf(list)
+	if rlist.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("expected a list, got %T", list)
+	}
+	res := reflect.MakeSlice(rlist.Type(), 0, rlist.Len())
+	for i := 0; i < rlist.Len(); i++ {
+		if item := rlist.Index(i); keep(item.Interface()) {
+			res = reflect.Append(res, item)
+		}
+	}
+	return res.Interface(), nil
+}
+
+// naturalLess compares strings with runs of digits compared by value, so that
+// "node2" sorts before "node10".
+func naturalLess(a, b string) bool {
+	for len(a) > 0 && len(b) > 0 {
+		da, db := leadingDigits(a), leadingDigits(b)
+		if len(da) > 0 && len(db) > 0 {
+			na, _ := strconv.ParseUint(da, 10, 64)
+			nb, _ := strconv.ParseUint(db, 10, 64)
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func leadingDigits(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
+
+// sequenceOf returns the numeric suffix zookeeper appends to sequential nodes,
+// or -1 when the name has none.
+func sequenceOf(name string) int64 {
+	i := len(name)
+	for i > 0 && unicode.IsDigit(rune(name[i-1])) {
+		i--
+	}
+	seq, err := strconv.ParseInt(name[i:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return seq
+}
+
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return rv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+	return rv.IsZero()
+}
@@ -0,0 +1,103 @@
+package ZkAgent
+
+import (
+	"fmt"
+	"time"
+)
+
+// Group renders several pipelines as one transaction: the targets of all
+// member pipelines are staged and validated together, promoted together and
+// followed by a single Command. If any step fails, every target of the group
+// is left as, or restored to, its previous content.
+type Group struct {
+	Name      string
+	Pipelines []*Pipeline
+	// Roots are the roots of all member pipelines, offered to the group
+	// commands.
+	Roots []string
+	// CheckCommand runs once after the member check commands, with every
+	// staged file of the group available as `{{ stagedOf TARGET }}`.
+	CheckCommand Command
+	Command      Command
+	Signal       *SignalAction
+	Wait         WaitOptions
+}
+
+// reloadUnit is what a change triggers: a standalone pipeline, or a group
+// with all its member pipelines.
+type reloadUnit struct {
+	name      string
+	group     *Group
+	pipelines []*Pipeline
+	wait      WaitOptions
+}
+
+// command returns the reload command of the unit, and the roots and strict
+// mode its template is rendered with.
+func (self *reloadUnit) command() (*Command, []string, bool) {
+	if self.group != nil {
+		return &self.group.Command, self.group.Roots, false
+	}
+	pipeline := self.pipelines[0]
+	return &pipeline.Command, pipeline.Roots, pipeline.Strict
+}
+
+// signal returns the signal action of the unit, or nil.
+func (self *reloadUnit) signal() *SignalAction {
+	if self.group != nil {
+		return self.group.Signal
+	}
+	return self.pipelines[0].Signal
+}
+
+func newGroup(config GroupConfig) (*Group, error) {
+	group := &Group{
+		Name:         config.Name,
+		CheckCommand: newCommand(config.CheckCommand),
+		Command:      newCommand(config.ShellCommand),
+		Wait: WaitOptions{
+			Min: time.Duration(config.Wait.Min),
+			Max: time.Duration(config.Wait.Max),
+		},
+	}
+	if config.Signal != nil {
+		signal, err := newSignalAction(config.Signal)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid `signal` of group `%s`, cause by: %+v", config.Name, err)
+		}
+		group.Signal = signal
+	}
+	return group, nil
+}
+
+// buildUnits groups the pipelines into reload units, in declaration order. A
+// group takes the place of its first member.
+func buildUnits(config *Config, pipelines []*Pipeline) ([]*reloadUnit, error) {
+	groups := make(map[string]*reloadUnit)
+	for _, gconfig := range config.Groups {
+		group, err := newGroup(gconfig)
+		if err != nil {
+			return nil, err
+		}
+		groups[group.Name] = &reloadUnit{name: group.Name, group: group, wait: group.Wait}
+	}
+	var units []*reloadUnit
+	for i, pipeline := range pipelines {
+		unit, ok := groups[config.Pipelines[i].Group]
+		if !ok {
+			units = append(units, &reloadUnit{
+				name:      pipeline.Name,
+				pipelines: []*Pipeline{pipeline},
+				wait:      pipeline.Wait,
+			})
+			continue
+		}
+		if len(unit.pipelines) == 0 {
+			units = append(units, unit)
+		}
+		unit.pipelines = append(unit.pipelines, pipeline)
+		unit.group.Pipelines = unit.pipelines
+		unit.group.Roots = collectRoots(unit.pipelines)
+	}
+	return units, nil
+}
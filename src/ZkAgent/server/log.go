@@ -0,0 +1,188 @@
+package ZkAgent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (self Level) String() string {
+	if name, ok := levelNames[self]; ok {
+		return name
+	}
+	return strconv.Itoa(int(self))
+}
+
+// ParseLevel parses `debug`, `info`, `warn` (or `warning`) and `error`.
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(name)
+	if name == "warning" {
+		return LevelWarn, nil
+	}
+	for level, levelName := range levelNames {
+		if levelName == name {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level `%s`.", name)
+}
+
+// Logger receives the diagnostics of the agent. keyvals are alternating keys
+// and values, such as "pipeline", name, "path", nodePath.
+type Logger interface {
+	Log(level Level, msg string, keyvals ...interface{})
+}
+
+// Log formats supported by NewLogger.
+const (
+	LogFormatLogfmt = "logfmt"
+	LogFormatJSON   = "json"
+)
+
+type streamLogger struct {
+	lock   sync.Mutex
+	writer io.Writer
+	json   bool
+	level  Level
+}
+
+// NewLogger returns a Logger writing the entries of level and above to
+// writer, one per line, as logfmt or as JSON objects.
+func NewLogger(writer io.Writer, format string, level Level) (Logger, error) {
+	switch format {
+	case LogFormatLogfmt, "":
+		return &streamLogger{writer: writer, level: level}, nil
+	case LogFormatJSON:
+		return &streamLogger{writer: writer, json: true, level: level}, nil
+	}
+	return nil, fmt.Errorf("Unknown log format `%s`.", format)
+}
+
+func (self *streamLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	if level < self.level {
+		return
+	}
+	fields := append([]interface{}{"time", time.Now().Format(time.RFC3339Nano), "level", level.String(), "msg", msg}, keyvals...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, nil)
+	}
+	var buffer bytes.Buffer
+	if self.json {
+		writeJSONEntry(&buffer, fields)
+	} else {
+		writeLogfmtEntry(&buffer, fields)
+	}
+	buffer.WriteByte('\n')
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.writer.Write(buffer.Bytes())
+}
+
+// logValue turns errors, durations and other stringers into strings, which
+// both formats render as is.
+func logValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case nil:
+		return nil
+	case error:
+		return value.Error()
+	case fmt.Stringer:
+		return value.String()
+	}
+	return value
+}
+
+func writeJSONEntry(buffer *bytes.Buffer, fields []interface{}) {
+	buffer.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		value, err := json.Marshal(logValue(fields[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprintf("%+v", fields[i+1]))
+		}
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+}
+
+func writeLogfmtEntry(buffer *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buffer.WriteByte(' ')
+		}
+		buffer.WriteString(logfmtKey(fmt.Sprint(fields[i])))
+		buffer.WriteByte('=')
+		var value string
+		switch v := logValue(fields[i+1]).(type) {
+		case nil:
+		case string:
+			value = v
+		case []string:
+			value = strings.Join(v, ",")
+		default:
+			value = fmt.Sprintf("%+v", v)
+		}
+		if len(value) == 0 || strings.IndexFunc(value, needsQuote) >= 0 {
+			value = strconv.Quote(value)
+		}
+		buffer.WriteString(value)
+	}
+}
+
+func needsQuote(r rune) bool {
+	return r <= ' ' || r == '=' || r == '"' || r == '\\' || !unicode.IsPrint(r)
+}
+
+func logfmtKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if needsQuote(r) {
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+// zkLogger passes the messages of the zookeeper client to a Logger, as
+// warnings when they report a failure.
+type zkLogger struct {
+	logger Logger
+}
+
+func (self zkLogger) Printf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	level, lower := LevelInfo, strings.ToLower(msg)
+	for _, word := range []string{"fail", "terminated", "unknown", "but not"} {
+		if strings.Contains(lower, word) {
+			level = LevelWarn
+		}
+	}
+	self.logger.Log(level, msg, "component", "zk")
+}
@@ -0,0 +1,72 @@
+package ZkAgent
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogEntries(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []interface{}
+		logfmt string
+		json   string
+	}{
+		{
+			name:   "plain",
+			fields: []interface{}{"msg", "Started.", "count", 2},
+			logfmt: `msg=Started. count=2`,
+			json:   `{"msg":"Started.","count":2}`,
+		},
+		{
+			name:   "quoted",
+			fields: []interface{}{"msg", "Reload failed.", "empty", "", "path", `a="b"`},
+			logfmt: `msg="Reload failed." empty="" path="a=\"b\""`,
+			json:   `{"msg":"Reload failed.","empty":"","path":"a=\"b\""}`,
+		},
+		{
+			name:   "values",
+			fields: []interface{}{"error", errors.New("no node"), "wait", 1500 * time.Millisecond, "paths", []string{"/a", "/b"}, "none", nil},
+			logfmt: `error="no node" wait=1.5s paths=/a,/b none=""`,
+			json:   `{"error":"no node","wait":"1.5s","paths":["/a","/b"],"none":null}`,
+		},
+		{
+			name:   "key",
+			fields: []interface{}{"bad key=", "x"},
+			logfmt: `bad_key_=x`,
+			json:   `{"bad key=":"x"}`,
+		},
+	}
+	for _, test := range tests {
+		var buffer bytes.Buffer
+		writeLogfmtEntry(&buffer, test.fields)
+		if buffer.String() != test.logfmt {
+			t.Errorf("%s: logfmt %s, want %s", test.name, buffer.String(), test.logfmt)
+		}
+		buffer.Reset()
+		writeJSONEntry(&buffer, test.fields)
+		if buffer.String() != test.json {
+			t.Errorf("%s: json %s, want %s", test.name, buffer.String(), test.json)
+		}
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	var buffer bytes.Buffer
+	logger, err := NewLogger(&buffer, LogFormatJSON, LevelWarn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Log(LevelInfo, "Hidden.")
+	logger.Log(LevelError, "Shown.", "odd")
+	if lines := strings.Split(strings.TrimSpace(buffer.String()), "\n"); len(lines) != 1 ||
+		!strings.Contains(lines[0], `"level":"error","msg":"Shown.","odd":null}`) {
+		t.Errorf("logged %q", buffer.String())
+	}
+	if _, err := NewLogger(&buffer, "xml", LevelInfo); err == nil {
+		t.Error("NewLogger accepted an unknown format")
+	}
+}
@@ -0,0 +1,270 @@
+package ZkAgent
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the duration
+// histograms.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// failureReasons names the stage of a failed render in the metrics.
+var failureReasons = map[AgentEventType]string{
+	EventRenderFailed:  "render",
+	EventCheckFailed:   "check",
+	EventCommandFailed: "command",
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (self *histogram) observe(value float64) {
+	if self.counts == nil {
+		self.counts = make([]uint64, len(durationBuckets))
+	}
+	for i, bound := range durationBuckets {
+		if value <= bound {
+			self.counts[i]++
+		}
+	}
+	self.sum += value
+	self.count++
+}
+
+// metrics counts what the agent did since it started. The gauges of the
+// zookeeper data and of the pipelines are read from the agent when scraped.
+type metrics struct {
+	lock               sync.Mutex
+	renders            map[[2]string]uint64 // pipeline, result
+	renderFailures     map[[2]string]uint64 // pipeline, reason
+	renderDurations    map[string]*histogram
+	commandExits       map[[2]string]uint64 // pipeline, exit code
+	commandDurations   map[string]*histogram
+	zkEvents           map[string]uint64
+	stateTransitions   map[string]uint64
+	sessionExpirations uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		renders:          make(map[[2]string]uint64),
+		renderFailures:   make(map[[2]string]uint64),
+		renderDurations:  make(map[string]*histogram),
+		commandExits:     make(map[[2]string]uint64),
+		commandDurations: make(map[string]*histogram),
+		zkEvents:         make(map[string]uint64),
+		stateTransitions: make(map[string]uint64),
+	}
+}
+
+// observeEvent records the render and the command of an agent event.
+func (self *metrics) observeEvent(event *AgentEvent) {
+	name := event.source()
+	if len(name) == 0 {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	result := event.Type.String()
+	if event.DryRun {
+		result = "DryRun"
+	}
+	self.renders[[2]string{name, result}]++
+	if reason, ok := failureReasons[event.Type]; ok {
+		self.renderFailures[[2]string{name, reason}]++
+	}
+	observeDuration(self.renderDurations, name, event.Duration)
+	if len(event.Command) == 0 || event.DryRun {
+		return
+	}
+	self.recordCommand(name, event.CommandDuration, event.Attempts, event.ExitCode)
+}
+
+// observeCommand records a successful check command, which has no event of
+// its own: the event of the reload reports the reload command only.
+func (self *metrics) observeCommand(name string, run *commandRun) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	exitCode := 0
+	if run.result != nil {
+		exitCode = run.result.ExitCode
+	}
+	self.recordCommand(name, run.duration, run.attempts, exitCode)
+}
+
+func (self *metrics) recordCommand(name string, duration time.Duration, attempts int, exitCode int) {
+	observeDuration(self.commandDurations, name, duration)
+	// a signal has no exit code
+	if attempts > 0 {
+		self.commandExits[[2]string{name, strconv.Itoa(exitCode)}]++
+	}
+}
+
+// observeZkEvent records an event of the zookeeper connection.
+func (self *metrics) observeZkEvent(event zk.Event) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.zkEvents[event.Type.String()]++
+	if event.Type != zk.EventSession {
+		return
+	}
+	self.stateTransitions[event.State.String()]++
+	if event.State == zk.StateExpired {
+		self.sessionExpirations++
+	}
+}
+
+func observeDuration(histograms map[string]*histogram, name string, duration time.Duration) {
+	h, ok := histograms[name]
+	if !ok {
+		h = &histogram{}
+		histograms[name] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+// writeMetrics writes the metrics of the agent in the Prometheus text
+// exposition format.
+func (self *Agent) writeMetrics(w io.Writer) {
+	m := self.metrics
+	m.lock.Lock()
+	writeCounters(w, "zk_agent_renders_total", "Renders by pipeline and result, DryRun for the renders of a dry run.", []string{"pipeline", "result"}, m.renders)
+	writeCounters(w, "zk_agent_render_failures_total", "Failed renders by pipeline and failing stage.", []string{"pipeline", "reason"}, m.renderFailures)
+	writeHistograms(w, "zk_agent_render_duration_seconds", "Time taken to render, validate, write and reload a pipeline.", m.renderDurations)
+	writeCounters(w, "zk_agent_command_exits_total", "Reload and check commands by pipeline and exit code.", []string{"pipeline", "code"}, m.commandExits)
+	writeHistograms(w, "zk_agent_command_duration_seconds", "Time taken by the reload and check commands, retries included.", m.commandDurations)
+	writeHeader(w, "zk_agent_zk_events_total", "counter", "Events received from zookeeper by type.")
+	for _, value := range sortedKeys(m.zkEvents) {
+		writeSample(w, "zk_agent_zk_events_total", labels("type", value), float64(m.zkEvents[value]))
+	}
+	writeHeader(w, "zk_agent_zk_state_transitions_total", "counter", "Zookeeper connection state changes by new state.")
+	for _, value := range sortedKeys(m.stateTransitions) {
+		writeSample(w, "zk_agent_zk_state_transitions_total", labels("state", value), float64(m.stateTransitions[value]))
+	}
+	writeHeader(w, "zk_agent_zk_session_expirations_total", "counter", "Zookeeper sessions which expired.")
+	writeSample(w, "zk_agent_zk_session_expirations_total", "", float64(m.sessionExpirations))
+	m.lock.Unlock()
+
+	self.lock.Lock()
+	conn, zkData := self.conn, self.zkData
+	self.lock.Unlock()
+	connected := 0.0
+	if conn != nil && conn.State() == zk.StateHasSession {
+		connected = 1
+	}
+	writeHeader(w, "zk_agent_zk_connected", "gauge", "Whether the agent has a zookeeper session.")
+	writeSample(w, "zk_agent_zk_connected", "", connected)
+	nodes, bytes, watches := 0, 0, 0
+	if zkData != nil {
+		for _, node := range zkData.Snapshot() {
+			nodes++
+			bytes += len(node.Value)
+		}
+		watches = zkData.Watches()
+	}
+	writeHeader(w, "zk_agent_zk_nodes", "gauge", "Zookeeper nodes held in memory.")
+	writeSample(w, "zk_agent_zk_nodes", "", float64(nodes))
+	writeHeader(w, "zk_agent_zk_node_bytes", "gauge", "Size of the zookeeper node values held in memory.")
+	writeSample(w, "zk_agent_zk_node_bytes", "", float64(bytes))
+	writeHeader(w, "zk_agent_zk_watches", "gauge", "Zookeeper watches set by the agent.")
+	writeSample(w, "zk_agent_zk_watches", "", float64(watches))
+
+	writeHeader(w, "zk_agent_seconds_since_last_success", "gauge", "Time since the last successful render of a pipeline, absent before the first one.")
+	now := time.Now()
+	for _, status := range self.Status() {
+		if !status.LastSuccess.IsZero() {
+			writeSample(w, "zk_agent_seconds_since_last_success", labels("pipeline", status.Name), now.Sub(status.LastSuccess).Seconds())
+		}
+	}
+}
+
+func (self *Agent) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	self.writeMetrics(w)
+}
+
+func writeCounters(w io.Writer, name string, help string, names []string, counters map[[2]string]uint64) {
+	writeHeader(w, name, "counter", help)
+	keys := make([][2]string, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, key := range keys {
+		writeSample(w, name, labels(names[0], key[0], names[1], key[1]), float64(counters[key]))
+	}
+}
+
+func writeHistograms(w io.Writer, name string, help string, histograms map[string]*histogram) {
+	writeHeader(w, name, "histogram", help)
+	pipelines := make([]string, 0, len(histograms))
+	for pipeline := range histograms {
+		pipelines = append(pipelines, pipeline)
+	}
+	sort.Strings(pipelines)
+	for _, pipeline := range pipelines {
+		h := histograms[pipeline]
+		for i, bound := range durationBuckets {
+			writeSample(w, name+"_bucket", labels("pipeline", pipeline, "le", formatValue(bound)), float64(h.counts[i]))
+		}
+		writeSample(w, name+"_bucket", labels("pipeline", pipeline, "le", "+Inf"), float64(h.count))
+		writeSample(w, name+"_sum", labels("pipeline", pipeline), h.sum)
+		writeSample(w, name+"_count", labels("pipeline", pipeline), float64(h.count))
+	}
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(w io.Writer, name string, labels string, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatValue(value))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats name and value pairs as a label set.
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(counters map[string]uint64) []string {
+	keys := make([]string, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,70 @@
+package ZkAgent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	agent, runner, _ := newAdminAgent(t)
+	defer close(agent.done)
+	serveReloads(agent)
+	server := httptest.NewServer(agent.AdminHandler())
+	defer server.Close()
+
+	runner.result = CommandResult{ExitCode: 0}
+	if _, err := http.Post(server.URL+"/v1/reload/app", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("Content-Type = %q", contentType)
+	}
+	for _, want := range []string{
+		"# TYPE zk_agent_renders_total counter",
+		`zk_agent_renders_total{pipeline="app",result="Rendered"} 1`,
+		`zk_agent_command_exits_total{pipeline="app",code="0"} 1`,
+		`zk_agent_render_duration_seconds_count{pipeline="app"} 1`,
+		"zk_agent_zk_connected 0",
+		"zk_agent_zk_nodes 4",
+		`zk_agent_seconds_since_last_success{pipeline="app"}`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("metrics miss %q:\n%s", want, data)
+		}
+	}
+}
+
+func TestMetricsCountChecks(t *testing.T) {
+	dir := t.TempDir()
+	runner := &fakeRunner{}
+	config := Config{
+		ZkServer: StringList{"127.0.0.1:2181"},
+		StateDir: dir,
+		Pipelines: []PipelineConfig{{
+			Name:         "app",
+			ZkDataPath:   StringList{"/app"},
+			Template:     writeFile(t, dir, "app.tmpl", `port={{ value "/app/a" }}`),
+			Target:       filepath.Join(dir, "app.conf"),
+			CheckCommand: CommandConfig{Shell: "check app"},
+			ShellCommand: CommandConfig{Shell: "reload app"},
+		}},
+	}
+	agent := newTestAgent(t, config, runner, testSnapshot())
+	agent.emit(agent.reload(agent.units[0], nil, true, false))
+	var buf bytes.Buffer
+	agent.writeMetrics(&buf)
+	if want := `zk_agent_command_exits_total{pipeline="app",code="0"} 2`; !strings.Contains(buf.String(), want) {
+		t.Errorf("metrics miss %q:\n%s", want, buf.String())
+	}
+}
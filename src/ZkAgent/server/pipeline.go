@@ -0,0 +1,156 @@
+package ZkAgent
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Pipeline binds a set of zookeeper roots to one template, its target file
+// and the command to invoke after the target has been rebuilt.
+type Pipeline struct {
+	Name     string
+	Roots    []string
+	Matcher  *regexp.Regexp
+	Template string
+	Target   string
+	Command  Command
+	// CheckCommand validates the staged file before it replaces the target.
+	CheckCommand Command
+	// Signal, when set, replaces Command.
+	Signal *SignalAction
+	File   FileOptions
+	// Force rewrites the target and runs the command even when the rendered
+	// content is unchanged.
+	Force bool
+	Wait  WaitOptions
+	// Strict fails the render on missing keys and nodes instead of rendering
+	// empty values.
+	Strict bool
+	// CodecRules and Codec decode the node values for the templates.
+	CodecRules []codecRule
+	Codec      Codec
+	// FanOut renders one file per child node instead of the single Target.
+	FanOut *FanOutOptions
+	// Dependencies are the paths read by the templates, found when the
+	// pipeline is created.
+	Dependencies []Dependency
+}
+
+// Covers reports whether a change of nodePath concerns this pipeline, that is
+// the path lies under one of its roots, satisfies its matcher and may alter
+// what the templates read.
+func (self *Pipeline) Covers(nodePath string) bool {
+	covered := false
+	for _, root := range self.Roots {
+		if isUnderRoot(nodePath, root) {
+			covered = true
+			break
+		}
+	}
+	if !covered {
+		return false
+	}
+	if self.Matcher != nil && !self.Matcher.MatchString(nodePath) {
+		return false
+	}
+	for _, dep := range self.Dependencies {
+		if dep.Matches(nodePath) {
+			return true
+		}
+	}
+	return false
+}
+
+func isUnderRoot(nodePath string, root string) bool {
+	if root == "/" || nodePath == root {
+		return true
+	}
+	return strings.HasPrefix(nodePath, strings.TrimSuffix(root, "/")+"/")
+}
+
+func newPipeline(config PipelineConfig, stateDir string) (*Pipeline, error) {
+	pipeline := &Pipeline{
+		Name:         config.Name,
+		Roots:        config.ZkDataPath,
+		Template:     config.Template,
+		Target:       config.Target,
+		Command:      newCommand(config.ShellCommand),
+		CheckCommand: newCommand(config.CheckCommand),
+		Force:        config.Force,
+		Strict:       config.Strict,
+		Wait: WaitOptions{
+			Min: time.Duration(config.Wait.Min),
+			Max: time.Duration(config.Wait.Max),
+		},
+		File: FileOptions{
+			Mode:   os.FileMode(config.FileMode),
+			Uid:    -1,
+			Gid:    -1,
+			Backup: config.Backup,
+		},
+	}
+	if config.FanOut != nil {
+		pipeline.FanOut = &FanOutOptions{
+			Path:     config.FanOut.Path,
+			Manifest: config.FanOut.Manifest,
+		}
+		if len(pipeline.FanOut.Manifest) == 0 {
+			pipeline.FanOut.Manifest = defaultManifest(config.Name, stateDir)
+		}
+	}
+	if config.Signal != nil {
+		signal, err := newSignalAction(config.Signal)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid `signal` of pipeline `%s`, cause by: %+v", config.Name, err)
+		}
+		pipeline.Signal = signal
+	}
+	if len(config.Codec) > 0 {
+		codec, ok := codecs[config.Codec]
+		if !ok {
+			return nil, fmt.Errorf("Unknown codec `%s` of pipeline `%s`.", config.Codec, config.Name)
+		}
+		pipeline.Codec = codec
+	}
+	for _, rule := range config.Codecs {
+		codec, ok := codecs[rule.Codec]
+		if !ok {
+			return nil, fmt.Errorf("Unknown codec `%s` of pipeline `%s`.", rule.Codec, config.Name)
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid codec pattern of pipeline `%s`, cause by: %+v", config.Name, err)
+		}
+		pipeline.CodecRules = append(pipeline.CodecRules, codecRule{pattern: re, codec: codec})
+	}
+	if config.Uid != nil {
+		pipeline.File.Uid = *config.Uid
+	}
+	if config.Gid != nil {
+		pipeline.File.Gid = *config.Gid
+	}
+	if len(config.PathMatcher) > 0 {
+		re, err := regexp.Compile(config.PathMatcher)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid `pathMatcher` of pipeline `%s`, cause by: %+v", config.Name, err)
+		}
+		pipeline.Matcher = re
+	}
+	pipeline.Dependencies = analyzeDependencies(pipeline)
+	return pipeline, nil
+}
+
+func buildPipelines(config *Config) ([]*Pipeline, error) {
+	pipelines := make([]*Pipeline, 0, len(config.Pipelines))
+	for _, pconfig := range config.Pipelines {
+		pipeline, err := newPipeline(pconfig, config.StateDir)
+		if err != nil {
+			return nil, err
+		}
+		pipelines = append(pipelines, pipeline)
+	}
+	return pipelines, nil
+}
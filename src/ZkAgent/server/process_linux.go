@@ -0,0 +1,146 @@
+//go:build linux
+// +build linux
+
+package ZkAgent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// processLookupSupported tells whether processes can be looked up by name.
+const processLookupSupported = true
+
+// clockTicks is USER_HZ, the unit of the times in /proc, 100 on every
+// architecture.
+const clockTicks = 100
+
+// findProcesses returns the processes whose command name, or the base name of
+// their executable, is name. Children of a match, such as the workers of a
+// master process, are left out.
+func findProcesses(name string) ([]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("Look up process `%s` failed, cause by: %+v", name, err)
+	}
+	parents := make(map[int]int)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		comm, ppid, ok := readProcStat(pid)
+		if !ok {
+			continue
+		}
+		if comm != name && processExecutable(pid) != name {
+			continue
+		}
+		parents[pid] = ppid
+	}
+	var pids []int
+	for pid, ppid := range parents {
+		if _, ok := parents[ppid]; !ok {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// verifyProcess checks that pid, read from a pidfile written at written, is
+// still the process which wrote it: it must have started before, and be
+// named name when given.
+func verifyProcess(pid int, written time.Time, name string) error {
+	comm, _, ok := readProcStat(pid)
+	if !ok {
+		return fmt.Errorf("process %d is not running", pid)
+	}
+	if len(name) > 0 && comm != name && processExecutable(pid) != name {
+		return fmt.Errorf("process %d is `%s`, not `%s`", pid, comm, name)
+	}
+	started, err := processStartTime(pid)
+	if err != nil {
+		return err
+	}
+	// the boot time is truncated to the second
+	if started.After(written.Add(time.Second)) {
+		return fmt.Errorf("process %d started after the pidfile was written", pid)
+	}
+	return nil
+}
+
+// readProcStat returns the command name and the parent of a process.
+func readProcStat(pid int) (string, int, bool) {
+	comm, fields, ok := procStat(pid)
+	if !ok || len(fields) < 2 {
+		return "", 0, false
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", 0, false
+	}
+	return comm, ppid, true
+}
+
+// procStat returns the command name of a process and the fields of its stat
+// following it, starting with the state.
+func procStat(pid int) (string, []string, bool) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", nil, false
+	}
+	// pid (comm) state ppid ..., comm may itself contain spaces and parens.
+	stat := string(data)
+	open, end := strings.IndexByte(stat, '('), strings.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return "", nil, false
+	}
+	return stat[open+1 : end], strings.Fields(stat[end+1:]), true
+}
+
+// processStartTime returns when a process started, from its start time in
+// clock ticks since boot.
+func processStartTime(pid int) (time.Time, error) {
+	_, fields, ok := procStat(pid)
+	if !ok || len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("process %d is not running", pid)
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid start time of process %d", pid)
+	}
+	boot, err := bootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return boot.Add(time.Duration(ticks) * time.Second / clockTicks), nil
+}
+
+func bootTime() (time.Time, error) {
+	data, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "btime" {
+			seconds, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				break
+			}
+			return time.Unix(seconds, 0), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no boot time in /proc/stat")
+}
+
+func processExecutable(pid int) string {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil || len(data) == 0 {
+		return ""
+	}
+	return filepath.Base(strings.SplitN(string(data), "\x00", 2)[0])
+}
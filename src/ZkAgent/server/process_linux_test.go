@@ -0,0 +1,56 @@
+//go:build linux
+// +build linux
+
+package ZkAgent
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestVerifyProcess(t *testing.T) {
+	pid := os.Getpid()
+	comm, _, ok := readProcStat(pid)
+	if !ok {
+		t.Fatal("no stat of the test process")
+	}
+	started, err := processStartTime(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		pid     int
+		written time.Time
+		comm    string
+		err     bool
+	}{
+		{name: "same process", pid: pid, written: time.Now()},
+		{name: "same name", pid: pid, written: time.Now(), comm: comm},
+		{name: "other name", pid: pid, written: time.Now(), comm: comm + "-other", err: true},
+		{name: "reused pid", pid: pid, written: started.Add(-time.Hour), err: true},
+		// above the largest pid_max
+		{name: "not running", pid: 1<<22 + 1, written: time.Now(), err: true},
+	}
+	for _, test := range tests {
+		if err := verifyProcess(test.pid, test.written, test.comm); (err != nil) != test.err {
+			t.Errorf("%s: error %v", test.name, err)
+		}
+	}
+}
+
+func TestFindProcesses(t *testing.T) {
+	comm, _, _ := readProcStat(os.Getpid())
+	pids, err := findProcesses(comm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, pid := range pids {
+		found = found || pid == os.Getpid()
+	}
+	if !found {
+		t.Errorf("findProcesses(%q) = %v, without the test process", comm, pids)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package ZkAgent
+
+import (
+	"errors"
+	"time"
+)
+
+// processLookupSupported tells whether processes can be looked up by name.
+const processLookupSupported = false
+
+func findProcesses(name string) ([]int, error) {
+	return nil, errors.New("Looking up a process by name is only supported on Linux.")
+}
+
+// verifyProcess cannot tell the process which wrote a pidfile from one which
+// reused its pid here: the pidfile is trusted.
+func verifyProcess(pid int, written time.Time, name string) error {
+	return nil
+}
@@ -0,0 +1,440 @@
+package ZkAgent
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// reloadAll refreshes nodePath and its subtree, and hands every node which
+// changed, such as the descendants of a node created with its children, to
+// the pipelines covering it. When the refresh fails nothing is rendered: the
+// previous data is kept and Resync catches up on the next session.
+func (self *Agent) reloadAll(nodePath string) {
+	previous := self.zkData.Snapshot()
+	if err := self.zkData.GetNodesW([]string{nodePath}); err != nil {
+		self.logger.Log(LevelError, "Refresh node failed, keep the previous data.", "path", nodePath, "error", err)
+		return
+	}
+	self.saveCache(self.zkData)
+	changed := diffNodes(previous, self.zkData.Snapshot())
+	if !containsString(changed, nodePath) {
+		changed = append(changed, nodePath)
+	}
+	self.dispatch(changed)
+}
+
+// dispatch hands changed paths to the pipelines covering them. Units without
+// a wait window reload at once, the others coalesce the changes in their
+// debouncer. A group reloads once for the paths covered by any member.
+func (self *Agent) dispatch(changedPaths []string) {
+	for _, unit := range self.units {
+		var covered []string
+		for _, nodePath := range changedPaths {
+			for _, pipeline := range unit.pipelines {
+				if pipeline.Covers(nodePath) {
+					covered = append(covered, nodePath)
+					break
+				}
+			}
+		}
+		if len(covered) == 0 {
+			continue
+		}
+		if unit.wait.Min <= 0 {
+			self.emit(self.reload(unit, covered, true, false))
+			continue
+		}
+		for _, nodePath := range covered {
+			self.debouncers[unit].add(nodePath)
+		}
+	}
+}
+
+// rendered is the outcome of rendering one pipeline of a reload unit.
+type rendered struct {
+	pipeline *Pipeline
+	snapshot Snapshot
+	outputs  []output
+	changes  changeSet
+	// claimed is set with the files the fan-out pipeline owned before its
+	// outputs were claimed, restored when the reload fails.
+	claimed *[]string
+}
+
+// reload renders the pipelines of the unit into staging files, validates each
+// of them with the check command of its pipeline, and those of a group with
+// the group check command, promotes them over their targets and finally
+// invokes the reload command, or sends the reload signal, once. If the reload
+// fails, all the previous targets are restored. Nothing is written or invoked
+// when the rendered content equals the targets on disk, unless the pipeline or
+// this reload is forced, nor in dry-run mode. The templates and the commands
+// all see the same snapshot of the data.
+func (self *Agent) reload(unit *reloadUnit, changedPaths []string, runCommand bool, force bool) *AgentEvent {
+	start := time.Now()
+	raw := self.zkData.Snapshot()
+	var results []*rendered
+	var changes changeSet
+	fail := func(eventType AgentEventType, err error) *AgentEvent {
+		event := newAgentEvent(eventType, unit, changedPaths)
+		event.Duration = time.Since(start)
+		event.Hash, event.PreviousHash = changes.hashes()
+		event.Files = changes.pending().files()
+		event.Err = err
+		return event
+	}
+	for _, pipeline := range unit.pipelines {
+		res := &rendered{pipeline: pipeline, snapshot: self.decode(pipeline, raw)}
+		var removals []string
+		var err error
+		res.outputs, removals, err = self.render(pipeline, res.snapshot)
+		if err == nil {
+			res.changes, err = planChanges(res.outputs, removals, pipeline.Force || force, pipeline.File)
+		}
+		if err != nil {
+			event := fail(EventRenderFailed, err)
+			event.Pipeline = pipeline.Name
+			return event
+		}
+		results = append(results, res)
+		changes = append(changes, res.changes...)
+	}
+	pending := changes.pending()
+	if len(pending) == 0 {
+		if err := self.updateManifests(results); err != nil {
+			self.logger.Log(LevelError, "Update manifest failed.", "pipeline", unit.name, "error", err)
+		}
+		return fail(EventUnchanged, nil)
+	}
+	hash, previousHash := changes.hashes()
+	if self.dryRun {
+		event := fail(EventRendered, nil)
+		self.reportDryRun(unit, raw, results, pending, runCommand, event)
+		return event
+	}
+	if err := self.claimManifests(results); err != nil {
+		self.releaseManifests(unit, results)
+		return fail(EventRenderFailed, err)
+	}
+	if err := pending.stage(); err != nil {
+		self.releaseManifests(unit, results)
+		return fail(EventRenderFailed, err)
+	}
+	for _, res := range results {
+		if res.pipeline.CheckCommand.IsEmpty() {
+			continue
+		}
+		for _, change := range res.changes.pending() {
+			if change.remove {
+				continue
+			}
+			vars := commandVars{
+				name:         res.pipeline.Name,
+				target:       change.target,
+				staged:       change.staged,
+				changed:      changedPaths,
+				files:        pending.files(),
+				hash:         change.hash,
+				previousHash: change.previousHash,
+			}
+			run, err := self.runCommand(res.snapshot, res.pipeline.Roots, res.pipeline.Strict, &res.pipeline.CheckCommand, vars)
+			if err != nil {
+				pending.discard()
+				self.releaseManifests(unit, results)
+				event := fail(EventCheckFailed, err)
+				event.Pipeline = res.pipeline.Name
+				run.report(event)
+				return event
+			}
+			self.metrics.observeCommand(unit.name, run)
+		}
+	}
+	if group := unit.group; group != nil && !group.CheckCommand.IsEmpty() {
+		vars := commandVars{
+			name:         group.Name,
+			changed:      changedPaths,
+			files:        pending.files(),
+			stagedFiles:  pending.stagedFiles(),
+			hash:         hash,
+			previousHash: previousHash,
+		}
+		run, err := self.runCommand(raw, group.Roots, false, &group.CheckCommand, vars)
+		if err != nil {
+			pending.discard()
+			self.releaseManifests(unit, results)
+			event := fail(EventCheckFailed, err)
+			run.report(event)
+			return event
+		}
+		self.metrics.observeCommand(unit.name, run)
+	}
+	if err := pending.promote(); err != nil {
+		self.releaseManifests(unit, results)
+		return fail(EventRenderFailed, err)
+	}
+
+	var run *commandRun
+	var err error
+	if signal := unit.signal(); runCommand && signal != nil {
+		run, err = self.sendSignal(signal)
+	} else if command, roots, strict := unit.command(); runCommand && !command.IsEmpty() {
+		data, vars := unitCommandVars(unit, raw, results, changedPaths, pending, hash, previousHash)
+		run, err = self.runCommand(data, roots, strict, command, vars)
+	}
+	if err != nil {
+		if rerr := pending.restore(); rerr != nil {
+			err = fmt.Errorf("%+v; %+v", err, rerr)
+		}
+		self.releaseManifests(unit, results)
+		event := fail(EventCommandFailed, err)
+		run.report(event)
+		return event
+	}
+	event := fail(EventRendered, nil)
+	run.report(event)
+	if err := self.updateManifests(results); err != nil {
+		self.logger.Log(LevelError, "Update manifest failed.", "pipeline", unit.name, "error", err)
+	}
+	return event
+}
+
+// unitCommandVars returns the data and the values offered to the reload
+// command of unit: a group command sees the raw data, the command of a
+// pipeline its decoded data and its target.
+func unitCommandVars(unit *reloadUnit, raw Snapshot, results []*rendered, changedPaths []string, pending changeSet, hash string, previousHash string) (Snapshot, commandVars) {
+	vars := commandVars{
+		name:         unit.name,
+		changed:      changedPaths,
+		files:        pending.files(),
+		hash:         hash,
+		previousHash: previousHash,
+	}
+	if unit.group != nil {
+		return raw, vars
+	}
+	pipeline := unit.pipelines[0]
+	vars.target = pipeline.Target
+	if pipeline.FanOut == nil {
+		vars.staged = pipeline.Target
+	}
+	return results[0].snapshot, vars
+}
+
+// reportDryRun logs the diff of every pending change and the reload which
+// would follow, and records them on event.
+func (self *Agent) reportDryRun(unit *reloadUnit, raw Snapshot, results []*rendered, pending changeSet, runCommand bool, event *AgentEvent) {
+	event.DryRun = true
+	var diffs []string
+	for _, change := range pending {
+		from, to := change.target, change.target+" (rendered)"
+		if !change.existed {
+			from = ""
+		}
+		if change.remove {
+			to = ""
+		}
+		diff := unifiedDiff(from, to, change.previous, change.data)
+		if len(diff) == 0 {
+			// forced rewrite of an identical file
+			diff = fmt.Sprintf("--- %s\n+++ %s\n", change.target, to)
+		}
+		self.logger.Log(LevelInfo, "Dry run: would write target.", "pipeline", unit.name, "target", change.target, "diff", diff)
+		diffs = append(diffs, diff)
+	}
+	event.Diff = strings.Join(diffs, "")
+	if !runCommand {
+		return
+	}
+	if signal := unit.signal(); signal != nil {
+		event.Command = signal.String()
+	} else if command, roots, strict := unit.command(); !command.IsEmpty() {
+		data, vars := unitCommandVars(unit, raw, results, event.Paths, pending, event.Hash, event.PreviousHash)
+		invocation, err := self.renderCommand(data, roots, strict, command, vars)
+		if err != nil {
+			event.Type, event.Err = EventCommandFailed, err
+			return
+		}
+		event.Command = invocation.String()
+	}
+	if len(event.Command) > 0 {
+		self.logger.Log(LevelInfo, "Dry run: would run command.", "pipeline", unit.name, "command", event.Command)
+	}
+}
+
+// decode returns raw with the node values under the roots of the pipeline
+// decoded by its codecs. A node failing to decode is reported once per
+// modification of its value, not at every render.
+func (self *Agent) decode(pipeline *Pipeline, raw Snapshot) Snapshot {
+	snapshot := decodeNodes(raw, pipeline.Roots, pipeline.CodecRules, pipeline.Codec)
+	self.decodeLock.Lock()
+	defer self.decodeLock.Unlock()
+	reported := self.decodeErrors[pipeline.Name]
+	failed := make(map[string]int64)
+	for _, node := range snapshot {
+		if len(node.ParseError) == 0 {
+			continue
+		}
+		failed[node.Path] = node.Stat.Mzxid
+		if mzxid, ok := reported[node.Path]; ok && mzxid == node.Stat.Mzxid {
+			continue
+		}
+		self.logger.Log(LevelWarn, "Decode node failed.", "pipeline", pipeline.Name, "path", node.Path, "error", node.ParseError)
+	}
+	if self.decodeErrors == nil {
+		self.decodeErrors = make(map[string]map[string]int64)
+	}
+	self.decodeErrors[pipeline.Name] = failed
+	return snapshot
+}
+
+// render returns the outputs of the pipeline, and for fan-out pipelines the
+// owned files which are not rendered anymore.
+func (self *Agent) render(pipeline *Pipeline, data Snapshot) ([]output, []string, error) {
+	funcs := self.templateFuncs(data, pipeline)
+	if pipeline.FanOut != nil {
+		return renderFanOut(pipeline, data, funcs)
+	}
+	res, err := renderTemplate(pipeline.Template, pipeline.Target, data, funcs, pipeline.Strict)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []output{{target: pipeline.Target, data: res}}, nil, nil
+}
+
+// claimManifests records the files about to be written by the fan-out
+// pipelines as theirs, see claimManifest.
+func (self *Agent) claimManifests(results []*rendered) error {
+	for _, res := range results {
+		if res.pipeline.FanOut == nil {
+			continue
+		}
+		owned, err := claimManifest(res.pipeline.FanOut.Manifest, res.outputs)
+		if err != nil {
+			return fmt.Errorf("Update manifest of `%s` failed, cause by: %+v", res.pipeline.Name, err)
+		}
+		res.claimed = &owned
+	}
+	return nil
+}
+
+// releaseManifests writes back the manifests claimed by claimManifests, once
+// the files they were claimed for are restored or were never written.
+func (self *Agent) releaseManifests(unit *reloadUnit, results []*rendered) {
+	for _, res := range results {
+		if res.claimed == nil {
+			continue
+		}
+		if err := releaseManifest(res.pipeline.FanOut.Manifest, *res.claimed); err != nil {
+			self.logger.Log(LevelError, "Restore manifest failed.", "pipeline", unit.name, "error", err)
+			continue
+		}
+		res.claimed = nil
+	}
+}
+
+func (self *Agent) updateManifests(results []*rendered) error {
+	if self.dryRun {
+		return nil
+	}
+	for _, res := range results {
+		if res.pipeline.FanOut == nil {
+			continue
+		}
+		if err := updateManifest(res.pipeline.FanOut.Manifest, res.outputs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *Agent) templateFuncs(data Snapshot, pipeline *Pipeline) template.FuncMap {
+	return templateFuncs(data, pipeline.Roots, pipeline.Strict, self.logger)
+}
+
+// commandVars are the values offered to a command, through its template and
+// its environment.
+type commandVars struct {
+	name         string
+	target       string
+	staged       string
+	changed      []string
+	files        []string
+	stagedFiles  map[string]string
+	hash         string
+	previousHash string
+}
+
+// env describes the change to the command: ZK_AGENT_PIPELINE is the name of
+// the pipeline or group, ZK_AGENT_CHANGED_PATHS and ZK_AGENT_FILES are
+// newline separated lists.
+func (self *commandVars) env() []string {
+	return []string{
+		"ZK_AGENT_PIPELINE=" + self.name,
+		"ZK_AGENT_TARGET=" + self.target,
+		"ZK_AGENT_STAGED=" + self.staged,
+		"ZK_AGENT_CHANGED_PATHS=" + strings.Join(self.changed, "\n"),
+		"ZK_AGENT_FILES=" + strings.Join(self.files, "\n"),
+		"ZK_AGENT_HASH=" + self.hash,
+		"ZK_AGENT_PREVIOUS_HASH=" + self.previousHash,
+	}
+}
+
+// commandRun is what a command run reports to the agent event.
+type commandRun struct {
+	command  string
+	result   *CommandResult
+	attempts int
+	duration time.Duration
+}
+
+func (self *commandRun) report(event *AgentEvent) {
+	if self == nil {
+		return
+	}
+	event.Command, event.Attempts, event.CommandDuration = self.command, self.attempts, self.duration
+	if self.result != nil {
+		event.Stdout, event.Stderr, event.ExitCode = self.result.Stdout, self.result.Stderr, self.result.ExitCode
+	}
+}
+
+// renderCommand renders command against data. Besides the template
+// functions, the command can use `target` for the target path, `staged` for
+// the file being validated, `stagedOf TARGET` for the staged file of a target
+// of a group (the target itself when it is unchanged), `files` for the target
+// files written or removed and `changed` for the zookeeper paths whose changes
+// were coalesced into this reload.
+func (self *Agent) renderCommand(data Snapshot, roots []string, strict bool, command *Command, vars commandVars) (*Invocation, error) {
+	funcs := templateFuncs(data, roots, strict, self.logger)
+	funcs["target"] = func() string { return vars.target }
+	funcs["staged"] = func() string { return vars.staged }
+	funcs["stagedOf"] = func(target string) string {
+		if staged, ok := vars.stagedFiles[target]; ok {
+			return staged
+		}
+		return target
+	}
+	funcs["changed"] = func() []string { return vars.changed }
+	funcs["files"] = func() []string { return vars.files }
+	invocation, err := command.render(data, funcs, strict)
+	if err != nil {
+		return nil, err
+	}
+	invocation.Env = vars.env()
+	return invocation, nil
+}
+
+// runCommand renders command and runs it with the command runner.
+func (self *Agent) runCommand(data Snapshot, roots []string, strict bool, command *Command, vars commandVars) (*commandRun, error) {
+	invocation, err := self.renderCommand(data, roots, strict, command, vars)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	result, attempts, err := self.execute(command, invocation)
+	run := &commandRun{command: invocation.String(), result: result, attempts: attempts, duration: time.Since(start)}
+	if err != nil {
+		return run, fmt.Errorf("Execute command `%s` failed, cause by: %+v", run.command, err)
+	}
+	return run, nil
+}
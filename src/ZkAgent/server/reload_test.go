@@ -0,0 +1,129 @@
+package ZkAgent
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newReloadAgent(t *testing.T, command CommandConfig) (*Agent, *fakeRunner, string) {
+	dir := t.TempDir()
+	tmpl := writeFile(t, dir, "app.tmpl", `port={{ value "/app/a" }}`)
+	target := writeFile(t, dir, "app.conf", "port=0")
+	runner := &fakeRunner{}
+	config := Config{
+		ZkServer: StringList{"127.0.0.1:2181"},
+		StateDir: dir,
+		Pipelines: []PipelineConfig{{
+			Name:         "app",
+			ZkDataPath:   StringList{"/app"},
+			Template:     tmpl,
+			Target:       target,
+			ShellCommand: command,
+		}},
+	}
+	return newTestAgent(t, config, runner, testSnapshot()), runner, target
+}
+
+func TestReloadCommandFailureRestores(t *testing.T) {
+	agent, runner, target := newReloadAgent(t, CommandConfig{Shell: "reload app"})
+	runner.err = errors.New("exit status 1")
+	event := agent.reload(agent.units[0], []string{"/app/a"}, true, false)
+	if event.Type != EventCommandFailed || event.Err == nil {
+		t.Fatalf("event = %v, want CommandFailed", event)
+	}
+	if got := readTarget(t, target); got != "port=0" {
+		t.Errorf("target = %q, want the previous content restored", got)
+	}
+
+	runner.err = nil
+	event = agent.reload(agent.units[0], []string{"/app/a"}, true, false)
+	if event.Type != EventRendered || event.Err != nil {
+		t.Fatalf("event = %v, want Rendered", event)
+	}
+	if got := readTarget(t, target); got != "port=1" {
+		t.Errorf("target = %q, want the rendered content", got)
+	}
+	if event.Files[0] != target || len(event.Hash) == 0 || event.Hash == event.PreviousHash {
+		t.Errorf("event = %+v, want the file and its hashes", event)
+	}
+}
+
+func TestReloadRetries(t *testing.T) {
+	agent, runner, _ := newReloadAgent(t, CommandConfig{
+		Shell:       "reload app",
+		MaxAttempts: 3,
+		Backoff:     Duration(time.Millisecond),
+	})
+	runner.err = errors.New("exit status 1")
+	event := agent.reload(agent.units[0], nil, true, false)
+	if event.Type != EventCommandFailed || event.Attempts != 3 {
+		t.Errorf("event = %v after %d attempts, want CommandFailed after 3", event, event.Attempts)
+	}
+	if commands := runner.commands(); len(commands) != 3 {
+		t.Errorf("commands = %v, want 3 runs", commands)
+	}
+}
+
+func TestReloadDryRun(t *testing.T) {
+	agent, runner, target := newReloadAgent(t, CommandConfig{Shell: "reload app"})
+	agent.dryRun = true
+	event := agent.reload(agent.units[0], nil, true, false)
+	if event.Type != EventRendered || !event.DryRun {
+		t.Fatalf("event = %v, want a dry-run Rendered", event)
+	}
+	if got := readTarget(t, target); got != "port=0" {
+		t.Errorf("dry run wrote %q", got)
+	}
+	if commands := runner.commands(); len(commands) > 0 {
+		t.Errorf("dry run ran %v", commands)
+	}
+	if event.Command != "reload app" || len(event.Diff) == 0 {
+		t.Errorf("event = %+v, want the command and diff it would apply", event)
+	}
+	agent.emit(event)
+	if status := agent.Status()[0]; !status.LastSuccess.IsZero() || len(status.Hash) > 0 {
+		t.Errorf("status = %+v, want no success recorded", status)
+	}
+	var buf bytes.Buffer
+	agent.writeMetrics(&buf)
+	if want := `zk_agent_renders_total{pipeline="app",result="DryRun"} 1`; !strings.Contains(buf.String(), want) {
+		t.Errorf("metrics miss %q:\n%s", want, buf.String())
+	}
+}
+
+func TestReloadNestedCreation(t *testing.T) {
+	dir := t.TempDir()
+	tmpl := writeFile(t, dir, "app.tmpl", `port={{ value "/app/x/port" }}`)
+	target := filepath.Join(dir, "app.conf")
+	runner := &fakeRunner{}
+	config := Config{
+		ZkServer: StringList{"127.0.0.1:2181"},
+		StateDir: dir,
+		Pipelines: []PipelineConfig{{
+			Name:         "app",
+			ZkDataPath:   StringList{"/app"},
+			Template:     tmpl,
+			Target:       target,
+			ShellCommand: CommandConfig{Shell: "reload app"},
+		}},
+	}
+	agent := newTestAgent(t, config, runner, Snapshot{"/app": ZkNode{Path: "/app"}})
+	// /app/x and /app/x/port were created in one go, before any watch on
+	// /app/x: only the children of /app are reported
+	agent.zkData.reader = fakeZk{
+		"/app":        {children: []string{"x"}},
+		"/app/x":      {children: []string{"port"}},
+		"/app/x/port": {value: "80"},
+	}
+	agent.reloadAll("/app")
+	if got := readTarget(t, target); got != "port=80" {
+		t.Errorf("target = %q, want the new node rendered", got)
+	}
+	if commands := runner.commands(); len(commands) != 1 {
+		t.Errorf("commands = %v, want one reload", commands)
+	}
+}
@@ -0,0 +1,68 @@
+package ZkAgent
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// sessionTracker follows the connection state reported on the zookeeper event
+// channel and tells when the watches must be re-established: after a session
+// expiry (a new session holds none of the old watches) or a disconnect, during
+// which changes may have been missed.
+type sessionTracker struct {
+	conn         sessionConn
+	sessionID    int64
+	disconnected bool
+}
+
+// sessionConn is the part of the zookeeper connection sessionTracker reads.
+type sessionConn interface {
+	SessionID() int64
+}
+
+func newSessionTracker(conn sessionConn) *sessionTracker {
+	return &sessionTracker{conn: conn, sessionID: conn.SessionID()}
+}
+
+// update consumes a session event and reports whether a resync is needed.
+func (self *sessionTracker) update(event zk.Event) bool {
+	switch event.State {
+	case zk.StateDisconnected, zk.StateExpired:
+		self.disconnected = true
+	case zk.StateHasSession:
+		sessionID := self.conn.SessionID()
+		resync := self.disconnected || sessionID != self.sessionID
+		self.sessionID = sessionID
+		self.disconnected = false
+		return resync
+	}
+	return false
+}
+
+// diffNodes returns the sorted paths which were added, removed or modified
+// between two node maps.
+func diffNodes(previous Snapshot, current Snapshot) []string {
+	var changed []string
+	for nodePath, node := range current {
+		old, ok := previous[nodePath]
+		if !ok || !nodeEqual(old, node) {
+			changed = append(changed, nodePath)
+		}
+	}
+	for nodePath := range previous {
+		if _, ok := current[nodePath]; !ok {
+			changed = append(changed, nodePath)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func nodeEqual(a ZkNode, b ZkNode) bool {
+	return a.Value == b.Value &&
+		a.Stat.Version == b.Stat.Version &&
+		a.Stat.Cversion == b.Stat.Cversion &&
+		reflect.DeepEqual(a.Childs, b.Childs)
+}
@@ -0,0 +1,89 @@
+package ZkAgent
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+type fakeSession struct {
+	id int64
+}
+
+func (self *fakeSession) SessionID() int64 {
+	return self.id
+}
+
+func TestSessionTracker(t *testing.T) {
+	tests := []struct {
+		name   string
+		states []zk.State
+		// id is the session after the events
+		id     int64
+		resync bool
+	}{
+		{name: "connected", states: []zk.State{zk.StateConnected, zk.StateHasSession}, id: 1},
+		{name: "reconnected", states: []zk.State{zk.StateDisconnected, zk.StateConnecting, zk.StateHasSession}, id: 1, resync: true},
+		{name: "expired", states: []zk.State{zk.StateExpired, zk.StateHasSession}, id: 2, resync: true},
+		{name: "new session", states: []zk.State{zk.StateHasSession}, id: 2, resync: true},
+	}
+	for _, test := range tests {
+		conn := &fakeSession{id: 1}
+		tracker := newSessionTracker(conn)
+		conn.id = test.id
+		resync := false
+		for _, state := range test.states {
+			resync = tracker.update(zk.Event{Type: zk.EventSession, State: state})
+		}
+		if resync != test.resync {
+			t.Errorf("%s: resync = %v, want %v", test.name, resync, test.resync)
+		}
+		if tracker.update(zk.Event{Type: zk.EventSession, State: zk.StateHasSession}) {
+			t.Errorf("%s: resync again on the same session", test.name)
+		}
+	}
+}
+
+func TestDiffNodes(t *testing.T) {
+	previous := testSnapshot()
+	tests := []struct {
+		name    string
+		modify  func(current Snapshot)
+		changed []string
+	}{
+		{name: "same", modify: func(current Snapshot) {}},
+		{
+			name: "value",
+			modify: func(current Snapshot) {
+				current["/app/a"] = ZkNode{Path: "/app/a", Value: "3"}
+			},
+			changed: []string{"/app/a"},
+		},
+		{
+			name: "version only",
+			modify: func(current Snapshot) {
+				node := current["/other"]
+				node.Stat.Version++
+				current["/other"] = node
+			},
+			changed: []string{"/other"},
+		},
+		{
+			name: "added and removed",
+			modify: func(current Snapshot) {
+				delete(current, "/app/b")
+				current["/app"] = ZkNode{Path: "/app", Childs: []string{"a", "c"}}
+				current["/app/c"] = ZkNode{Path: "/app/c", Value: "3"}
+			},
+			changed: []string{"/app", "/app/b", "/app/c"},
+		},
+	}
+	for _, test := range tests {
+		current := testSnapshot()
+		test.modify(current)
+		if changed := diffNodes(previous, current); !reflect.DeepEqual(changed, test.changed) {
+			t.Errorf("%s: changed %v, want %v", test.name, changed, test.changed)
+		}
+	}
+}
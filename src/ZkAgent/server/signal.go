@@ -0,0 +1,97 @@
+package ZkAgent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultSignal = "HUP"
+
+// SignalAction reloads a daemon by sending it a signal rather than running a
+// command. The process is found through its PidFile, or by Process name. With
+// both, the process of the pidfile must be named Process.
+type SignalAction struct {
+	PidFile string
+	Process string
+	Name    string
+	Signal  os.Signal
+}
+
+func newSignalAction(config *SignalConfig) (*SignalAction, error) {
+	name := config.Signal
+	if len(name) == 0 {
+		name = defaultSignal
+	}
+	sig, err := parseSignal(name)
+	if err != nil {
+		return nil, err
+	}
+	return &SignalAction{
+		PidFile: config.PidFile,
+		Process: config.Process,
+		Name:    strings.TrimPrefix(strings.ToUpper(name), "SIG"),
+		Signal:  sig,
+	}, nil
+}
+
+func (self *SignalAction) String() string {
+	if len(self.PidFile) > 0 {
+		return fmt.Sprintf("signal %s to pidfile `%s`", self.Name, self.PidFile)
+	}
+	return fmt.Sprintf("signal %s to process `%s`", self.Name, self.Process)
+}
+
+// pids returns the processes to signal.
+func (self *SignalAction) pids() ([]int, error) {
+	if len(self.PidFile) > 0 {
+		data, err := ioutil.ReadFile(self.PidFile)
+		if err != nil {
+			return nil, fmt.Errorf("Read pidfile `%s` failed, cause by: %+v", self.PidFile, err)
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || pid <= 0 {
+			return nil, fmt.Errorf("Invalid pidfile `%s`.", self.PidFile)
+		}
+		info, err := os.Stat(self.PidFile)
+		if err != nil {
+			return nil, fmt.Errorf("Read pidfile `%s` failed, cause by: %+v", self.PidFile, err)
+		}
+		// a pid left by a process which is gone may have been reused since
+		if err := verifyProcess(pid, info.ModTime(), self.Process); err != nil {
+			return nil, fmt.Errorf("Stale pidfile `%s`: %v.", self.PidFile, err)
+		}
+		return []int{pid}, nil
+	}
+	pids, err := findProcesses(self.Process)
+	if err != nil {
+		return nil, err
+	}
+	if len(pids) == 0 {
+		return nil, fmt.Errorf("No process `%s` is running.", self.Process)
+	}
+	return pids, nil
+}
+
+// sendSignal signals the processes of action, after checking that they are
+// alive.
+func (self *Agent) sendSignal(action *SignalAction) (*commandRun, error) {
+	start := time.Now()
+	run := &commandRun{command: action.String()}
+	defer func() {
+		run.duration = time.Since(start)
+	}()
+	pids, err := action.pids()
+	if err != nil {
+		return run, err
+	}
+	for _, pid := range pids {
+		if err := signalProcess(pid, action.Signal); err != nil {
+			return run, fmt.Errorf("Send signal %s to process %d failed, cause by: %+v", action.Name, pid, err)
+		}
+	}
+	return run, nil
+}
@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package ZkAgent
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"TERM":  syscall.SIGTERM,
+	"WINCH": syscall.SIGWINCH,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+}
+
+// parseSignal accepts a signal name, with or without the SIG prefix, or its
+// number.
+func parseSignal(name string) (os.Signal, error) {
+	if n, err := strconv.Atoi(name); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	if sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(name), "SIG")]; ok {
+		return sig, nil
+	}
+	return nil, fmt.Errorf("unknown signal `%s`", name)
+}
+
+// signalProcess sends sig to pid, failing when the process is not running.
+func signalProcess(pid int, sig os.Signal) error {
+	if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+		return fmt.Errorf("process %d is not running", pid)
+	} else if err != nil {
+		return err
+	}
+	return syscall.Kill(pid, sig.(syscall.Signal))
+}
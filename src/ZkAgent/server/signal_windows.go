@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package ZkAgent
+
+import (
+	"errors"
+	"os"
+)
+
+func parseSignal(name string) (os.Signal, error) {
+	return nil, errors.New("signals are not supported on Windows")
+}
+
+func signalProcess(pid int, sig os.Signal) error {
+	return errors.New("signals are not supported on Windows")
+}
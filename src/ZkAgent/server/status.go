@@ -0,0 +1,78 @@
+package ZkAgent
+
+import (
+	"time"
+)
+
+// PipelineStatus is the outcome of the latest actions on a pipeline, or on a
+// group of pipelines.
+type PipelineStatus struct {
+	Name  string `json:"name"`
+	Group bool   `json:"group"`
+	// Pipelines are the members of a group, or the pipeline itself.
+	Pipelines     []string  `json:"pipelines"`
+	LastEvent     string    `json:"lastEvent"`
+	LastEventTime time.Time `json:"lastEventTime"`
+	// LastSuccess is the time of the latest render which succeeded, whether
+	// it wrote the targets or found them up to date; dry runs are left out.
+	// Hash is the hash of those targets.
+	LastSuccess time.Time `json:"lastSuccess"`
+	Hash        string    `json:"hash"`
+	// Error is the failure of the latest render, empty if it succeeded.
+	Error string `json:"error,omitempty"`
+	// Command, Stdout, Stderr and ExitCode describe the latest command run.
+	Command  string `json:"command,omitempty"`
+	Stdout   string `json:"stdout,omitempty"`
+	Stderr   string `json:"stderr,omitempty"`
+	ExitCode int    `json:"exitCode"`
+}
+
+// Status returns the status of every pipeline and group, in declaration
+// order.
+func (self *Agent) Status() []PipelineStatus {
+	self.statusLock.Lock()
+	defer self.statusLock.Unlock()
+	res := make([]PipelineStatus, 0, len(self.units))
+	for _, unit := range self.units {
+		status := PipelineStatus{Name: unit.name, Group: unit.group != nil}
+		if recorded, ok := self.status[unit.name]; ok {
+			status = *recorded
+		}
+		for _, pipeline := range unit.pipelines {
+			status.Pipelines = append(status.Pipelines, pipeline.Name)
+		}
+		res = append(res, status)
+	}
+	return res
+}
+
+// recordStatus updates the status of the pipeline or group of event.
+func (self *Agent) recordStatus(event *AgentEvent) {
+	name := event.source()
+	if len(name) == 0 {
+		return
+	}
+	self.statusLock.Lock()
+	defer self.statusLock.Unlock()
+	status, ok := self.status[name]
+	if !ok {
+		status = &PipelineStatus{Name: name, Group: len(event.Group) > 0}
+		self.status[name] = status
+	}
+	status.LastEvent, status.LastEventTime = event.Type.String(), event.Time
+	if event.Err != nil {
+		status.Error = event.Err.Error()
+	} else {
+		status.Error = ""
+		// a dry run left the targets as they were
+		if !event.DryRun {
+			status.LastSuccess = event.Time
+			if len(event.Hash) > 0 {
+				status.Hash = event.Hash
+			}
+		}
+	}
+	if len(event.Command) > 0 && !event.DryRun {
+		status.Command, status.Stdout, status.Stderr, status.ExitCode = event.Command, event.Stdout, event.Stderr, event.ExitCode
+	}
+}
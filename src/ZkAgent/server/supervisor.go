@@ -0,0 +1,208 @@
+package ZkAgent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+const (
+	defaultKillSignal  = "TERM"
+	defaultKillTimeout = 10 * time.Second
+)
+
+// Supervisor runs the child process the rendered files belong to. The child
+// starts once every target was rendered, receives the signals forwarded by
+// the caller, and is sent the reload signal, or restarted, whenever a target
+// changes. The agent stops when the child exits.
+type Supervisor struct {
+	agent *Agent
+	// Argv is executed directly, or Shell through the system shell.
+	Argv  []string
+	Shell string
+	// ReloadSignal is sent to the child on changes; when nil the child is
+	// stopped with KillSignal, killed after KillTimeout, and started again.
+	ReloadSignal os.Signal
+	KillSignal   os.Signal
+	KillTimeout  time.Duration
+
+	child     *exec.Cmd
+	childDone chan error
+}
+
+// NewSupervisor creates a Supervisor of agent. A command line string is run
+// through the system shell, a list of arguments directly.
+func NewSupervisor(agent *Agent, config ExecConfig) (*Supervisor, error) {
+	supervisor := &Supervisor{
+		agent:       agent,
+		KillTimeout: time.Duration(config.KillTimeout),
+	}
+	if config.Command.IsEmpty() {
+		return nil, errors.New("No command to execute.")
+	}
+	supervisor.Shell, supervisor.Argv = config.Command.Shell, config.Command.Argv
+	if len(config.ReloadSignal) > 0 {
+		sig, err := parseSignal(config.ReloadSignal)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid `reloadSignal`, cause by: %+v", err)
+		}
+		supervisor.ReloadSignal = sig
+	}
+	killSignal := config.KillSignal
+	if len(killSignal) == 0 {
+		killSignal = defaultKillSignal
+	}
+	sig, err := parseSignal(killSignal)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid `killSignal`, cause by: %+v", err)
+	}
+	supervisor.KillSignal = sig
+	if supervisor.KillTimeout <= 0 {
+		supervisor.KillTimeout = defaultKillTimeout
+	}
+	return supervisor, nil
+}
+
+// Run runs the agent and the child until the child exits, and returns its
+// exit code. signals are forwarded to the child, or stop the agent before the
+// child started. handle receives every agent event.
+func (self *Supervisor) Run(ctx context.Context, signals <-chan os.Signal, handle func(*AgentEvent)) (int, error) {
+	agentDone := make(chan error, 1)
+	go func() {
+		agentDone <- self.agent.Run(ctx)
+	}()
+	events := self.agent.Events()
+	ready := self.agent.Ready()
+	defer func() {
+		for event := range events {
+			handle(event)
+		}
+	}()
+	for {
+		select {
+		case <-ready:
+			ready = nil
+			if err := self.start(); err != nil {
+				self.agent.Stop()
+				<-agentDone
+				return 1, err
+			}
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			handle(event)
+		case <-self.agent.changed:
+			// The initial render precedes the child, and a dry run changes
+			// nothing: neither is notified.
+			if self.child == nil {
+				continue
+			}
+			if err := self.reload(); err != nil {
+				self.agent.Stop()
+				<-agentDone
+				return 1, err
+			}
+		case sig := <-signals:
+			if self.child == nil {
+				self.agent.Stop()
+				continue
+			}
+			self.child.Process.Signal(sig)
+		case err := <-self.childDone:
+			self.childDone = nil
+			self.agent.Stop()
+			<-agentDone
+			code := exitStatus(self.child.ProcessState)
+			if err != nil && code == 0 {
+				code = 1
+			}
+			return code, nil
+		case err := <-agentDone:
+			if self.child != nil {
+				self.stop()
+			}
+			if err != nil {
+				return 1, err
+			}
+			if self.child != nil {
+				return exitStatus(self.child.ProcessState), nil
+			}
+			return 0, nil
+		}
+	}
+}
+
+func (self *Supervisor) start() error {
+	var cmd *exec.Cmd
+	switch {
+	case len(self.Argv) > 0:
+		cmd = exec.Command(self.Argv[0], self.Argv[1:]...)
+	case runtime.GOOS == "windows":
+		cmd = exec.Command("cmd", "/c", self.Shell)
+	default:
+		cmd = exec.Command("sh", "-c", self.Shell)
+	}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// In its own process group the child only receives the signals we
+	// forward, not a second copy of those sent to the terminal group. Being
+	// then in the background, it must not read the terminal, or it would be
+	// stopped by SIGTTIN: it gets no stdin in that case.
+	if !isTerminal(os.Stdin) {
+		cmd.Stdin = os.Stdin
+	}
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Start child failed, cause by: %+v", err)
+	}
+	self.agent.logger.Log(LevelInfo, "Child started.", "pid", cmd.Process.Pid)
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	self.child, self.childDone = cmd, done
+	return nil
+}
+
+// isTerminal tells whether file is a character device, such as a terminal.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// reload signals the child, or restarts it.
+func (self *Supervisor) reload() error {
+	if self.ReloadSignal != nil {
+		// A child which exited meanwhile is reported through childDone.
+		if err := self.child.Process.Signal(self.ReloadSignal); err != nil {
+			self.agent.logger.Log(LevelError, "Signal child failed.", "error", err)
+		}
+		return nil
+	}
+	self.stop()
+	return self.start()
+}
+
+// stop asks the child to exit with KillSignal and kills its process group when
+// it is still running after KillTimeout.
+func (self *Supervisor) stop() {
+	if self.childDone == nil {
+		return
+	}
+	self.child.Process.Signal(self.KillSignal)
+	timer := time.NewTimer(self.KillTimeout)
+	defer timer.Stop()
+	select {
+	case <-self.childDone:
+	case <-timer.C:
+		self.agent.logger.Log(LevelWarn, "Child did not stop in time, kill it.", "timeout", self.KillTimeout)
+		killProcessGroup(self.child)
+		<-self.childDone
+	}
+	self.childDone = nil
+}
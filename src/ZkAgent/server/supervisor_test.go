@@ -0,0 +1,60 @@
+package ZkAgent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestNewSupervisorCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		shell   string
+		argv    []string
+	}{
+		{command: `"nginx -g 'daemon off;'"`, shell: "nginx -g 'daemon off;'"},
+		{command: `["nginx"]`, argv: []string{"nginx"}},
+		{command: `["nginx", "-g", "daemon off;"]`, argv: []string{"nginx", "-g", "daemon off;"}},
+	}
+	for _, test := range tests {
+		var config ExecConfig
+		if err := json.Unmarshal([]byte(`{"command": `+test.command+`}`), &config); err != nil {
+			t.Fatalf("%s: %v", test.command, err)
+		}
+		supervisor, err := NewSupervisor(nil, config)
+		if err != nil {
+			t.Fatalf("%s: %v", test.command, err)
+		}
+		if supervisor.Shell != test.shell || !reflect.DeepEqual(supervisor.Argv, test.argv) {
+			t.Errorf("%s: shell %q argv %q, want %q %q", test.command, supervisor.Shell, supervisor.Argv, test.shell, test.argv)
+		}
+	}
+	if _, err := NewSupervisor(nil, ExecConfig{}); err == nil {
+		t.Error("NewSupervisor accepted no command")
+	}
+}
+
+func TestChangeNotifiedWhenEventsFull(t *testing.T) {
+	logger, _ := NewLogger(ioutil.Discard, LogFormatLogfmt, LevelDebug)
+	agent, err := New(validConfig(), WithLogger(logger), WithEventBuffer(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial := newAgentEvent(EventRendered, agent.units[0], nil)
+	initial.Initial = true
+	agent.emit(initial)
+	select {
+	case <-agent.changed:
+		t.Error("initial render notified")
+	default:
+	}
+	// the events fill up and are dropped, the change is not
+	agent.emit(newAgentEvent(EventRendered, agent.units[0], nil))
+	agent.emit(newAgentEvent(EventRendered, agent.units[0], nil))
+	select {
+	case <-agent.changed:
+	default:
+		t.Error("change not notified")
+	}
+}
@@ -0,0 +1,93 @@
+package ZkAgent
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// TreeNode is the hierarchical view of a node offered to templates, see the
+// `root`, `node` and `walk` template functions.
+type TreeNode struct {
+	Name       string
+	Path       string
+	Parent     *TreeNode `json:"-"`
+	Children   []*TreeNode
+	Stat       zk.Stat
+	Value      string
+	Parsed     interface{} `json:",omitempty"`
+	ParseError string      `json:",omitempty"`
+}
+
+// Child returns the direct child called name, or nil.
+func (self *TreeNode) Child(name string) *TreeNode {
+	for _, child := range self.Children {
+		if child.Name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// Get returns the descendant at relPath, such as `dmz/upstream`, or nil.
+// `..` moves to the parent.
+func (self *TreeNode) Get(relPath string) *TreeNode {
+	node := self
+	for _, name := range strings.Split(relPath, "/") {
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			node = node.Parent
+		default:
+			node = node.Child(name)
+		}
+		if node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// Walk returns the node and all its descendants, depth-first.
+func (self *TreeNode) Walk() []*TreeNode {
+	return self.walk(nil)
+}
+
+func (self *TreeNode) walk(res []*TreeNode) []*TreeNode {
+	res = append(res, self)
+	for _, child := range self.Children {
+		res = child.walk(res)
+	}
+	return res
+}
+
+// buildTree links every node of data to its parent and children, which are
+// ordered by name. It returns the tree nodes by path.
+func buildTree(data Snapshot) map[string]*TreeNode {
+	index := make(map[string]*TreeNode, len(data))
+	for nodePath, node := range data {
+		index[nodePath] = &TreeNode{
+			Name:       path.Base(nodePath),
+			Path:       nodePath,
+			Stat:       node.Stat,
+			Value:      node.Value,
+			Parsed:     node.Parsed,
+			ParseError: node.ParseError,
+		}
+	}
+	for nodePath, treeNode := range index {
+		node := data[nodePath]
+		names := append([]string(nil), node.Childs...)
+		sort.Strings(names)
+		for _, name := range names {
+			if child, ok := index[path.Join(nodePath, name)]; ok {
+				child.Parent = treeNode
+				treeNode.Children = append(treeNode.Children, child)
+			}
+		}
+	}
+	return index
+}
@@ -0,0 +1,58 @@
+package ZkAgent
+
+import "testing"
+
+func TestBuildTree(t *testing.T) {
+	data := testSnapshot()
+	data["/app"] = ZkNode{Path: "/app", Childs: []string{"b", "a", "missing"}}
+	tree := buildTree(data)
+	app := tree["/app"]
+	if len(tree) != len(data) || app == nil || app.Parent != nil {
+		t.Fatalf("tree = %v", tree)
+	}
+	var names []string
+	for _, child := range app.Children {
+		names = append(names, child.Name)
+		if child.Parent != app {
+			t.Errorf("%s: parent %v", child.Path, child.Parent)
+		}
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Errorf("children %v, want the existing ones by name", names)
+	}
+	if walked := app.Walk(); len(walked) != 3 || walked[1].Value != "1" {
+		t.Errorf("walk = %v", walked)
+	}
+}
+
+func TestTreeNodeGet(t *testing.T) {
+	data := Snapshot{
+		"/app":              ZkNode{Path: "/app", Childs: []string{"dmz", "lan"}},
+		"/app/dmz":          ZkNode{Path: "/app/dmz", Childs: []string{"upstream"}},
+		"/app/dmz/upstream": ZkNode{Path: "/app/dmz/upstream", Value: "u"},
+		"/app/lan":          ZkNode{Path: "/app/lan", Value: "l"},
+	}
+	dmz := buildTree(data)["/app/dmz"]
+	tests := []struct {
+		relPath string
+		want    string
+	}{
+		{relPath: "", want: "/app/dmz"},
+		{relPath: ".", want: "/app/dmz"},
+		{relPath: "upstream", want: "/app/dmz/upstream"},
+		{relPath: "./upstream/", want: "/app/dmz/upstream"},
+		{relPath: "../lan", want: "/app/lan"},
+		{relPath: "../..", want: ""},
+		{relPath: "../../app", want: ""},
+		{relPath: "missing/upstream", want: ""},
+	}
+	for _, test := range tests {
+		got := ""
+		if node := dmz.Get(test.relPath); node != nil {
+			got = node.Path
+		}
+		if got != test.want {
+			t.Errorf("Get(%q) = %q, want %q", test.relPath, got, test.want)
+		}
+	}
+}
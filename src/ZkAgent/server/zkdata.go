@@ -0,0 +1,290 @@
+package ZkAgent
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// ZkData mirrors the watched zookeeper subtrees. Writers are serialized and
+// publish a fresh copy of the node map when done, so a Snapshot is never
+// modified once handed out and can be read without locking.
+type ZkData struct {
+	Conn *zk.Conn
+	// Roots are the watched top-level paths, which may not exist yet.
+	Roots []string
+	// Chroot is prepended to the paths sent to zookeeper; the paths of the
+	// snapshot are relative to it.
+	Chroot string
+	// SkipNoAuth leaves out the nodes the session is not allowed to read,
+	// reporting them to OnSkip, instead of failing the fetch. No watch is
+	// left on them.
+	SkipNoAuth bool
+	OnSkip     func(nodePath string, err error)
+
+	// reader replaces Conn for the reads when set.
+	reader zkReader
+
+	// writeLock serializes the writers, lock guards the published snapshot.
+	writeLock sync.Mutex
+	lock      sync.RWMutex
+	snapshot  Snapshot
+}
+
+// zkReader is the part of the zookeeper connection ZkData reads through.
+type zkReader interface {
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error)
+	ExistsW(path string) (bool, *zk.Stat, <-chan zk.Event, error)
+}
+
+type ZkNode struct {
+	Path   string
+	Stat   zk.Stat
+	Childs []string
+	Value  string
+	// Parsed is Value decoded by the codec configured for the node, and
+	// ParseError the reason it could not be decoded.
+	Parsed     interface{} `json:",omitempty"`
+	ParseError string      `json:",omitempty"`
+}
+
+// Snapshot is an immutable point-in-time view of ZkData, keyed by node path.
+// Templates receive it as their data.
+type Snapshot map[string]ZkNode
+
+func (self *ZkData) String() string {
+	bData, _ := json.Marshal(self.Snapshot())
+	if bData != nil {
+		return string(bData)
+	}
+	return ""
+}
+
+// Snapshot returns the current data. The result must not be modified.
+func (self *ZkData) Snapshot() Snapshot {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.snapshot
+}
+
+func (self *ZkData) publish(data Snapshot) {
+	self.lock.Lock()
+	self.snapshot = data
+	self.lock.Unlock()
+}
+
+func (self Snapshot) clone() Snapshot {
+	data := make(Snapshot, len(self))
+	for k, v := range self {
+		data[k] = v
+	}
+	return data
+}
+
+// GetNodesW fetches the given paths and their subtrees, replacing what was
+// known of them, and leaves data and children watches on every node. Nodes
+// that do not exist are removed; a missing root is watched with ExistsW so
+// that its creation is reported. On failure the previous data is kept.
+func (self *ZkData) GetNodesW(paths []string) error {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	data := self.Snapshot().clone()
+	if err := self.fetch(data, paths); err != nil {
+		// a partial fetch misses whole subtrees, keep the previous data
+		return err
+	}
+	self.publish(data)
+	return nil
+}
+
+// Resync fetches every root again with fresh watches, and returns the paths
+// whose node differs from the previously known data. On failure the previous
+// data is kept so that the next session can try again.
+func (self *ZkData) Resync() ([]string, error) {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	previous := self.Snapshot()
+	data := make(Snapshot)
+	if err := self.fetch(data, self.Roots); err != nil {
+		return nil, err
+	}
+	self.publish(data)
+	return diffNodes(previous, data), nil
+}
+
+func (self *ZkData) fetch(data Snapshot, paths []string) (err error) {
+	var conn zkReader = self.Conn
+	if self.reader != nil {
+		conn = self.reader
+	}
+	for _, _path := range paths {
+		// Clean old data first
+		data.deleteOldData(_path)
+
+		childs, stat, _, err := conn.ChildrenW(self.serverPath(_path))
+		if err == nil {
+			var bData []byte
+			bData, _, _, err = conn.GetW(self.serverPath(_path))
+			if err == nil {
+				data[_path] = ZkNode{
+					Path:   _path,
+					Stat:   *stat,
+					Childs: childs,
+					Value:  string(bData),
+				}
+			}
+		}
+		if err == zk.ErrNoNode {
+			data.removeNode(_path)
+			if !self.isRoot(_path) {
+				continue
+			}
+			exists, _, _, err := conn.ExistsW(self.serverPath(_path))
+			if err != nil {
+				return err
+			}
+			if exists {
+				// Created in the meantime, fetch it again.
+				if err := self.fetch(data, []string{_path}); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err == zk.ErrNoAuth {
+			if !self.SkipNoAuth {
+				return fmt.Errorf("Read node `%s` failed, cause by: %+v", _path, err)
+			}
+			data.removeNode(_path)
+			if self.OnSkip != nil {
+				self.OnSkip(_path, err)
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(childs) > 0 {
+			subPaths := make([]string, 0, 10)
+			for _, v := range childs {
+				subPath := path.Join(_path, v)
+				subPaths = append(subPaths, subPath)
+			}
+			err := self.fetch(data, subPaths)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Watches returns the number of watches left by the fetches: a data and a
+// children watch on every known node, an exists watch on every missing root.
+func (self *ZkData) Watches() int {
+	snapshot := self.Snapshot()
+	watches := 2 * len(snapshot)
+	for _, root := range self.Roots {
+		if _, ok := snapshot[root]; !ok {
+			watches++
+		}
+	}
+	return watches
+}
+
+// serverPath returns the path of nodePath on the server, below the chroot.
+func (self *ZkData) serverPath(nodePath string) string {
+	if len(self.Chroot) == 0 {
+		return nodePath
+	}
+	if nodePath == "/" {
+		return self.Chroot
+	}
+	return self.Chroot + nodePath
+}
+
+// LocalPath returns the path of a node reported by the server relative to
+// the chroot, and false when it is outside of it.
+func (self *ZkData) LocalPath(serverPath string) (string, bool) {
+	if len(self.Chroot) == 0 {
+		return serverPath, true
+	}
+	if serverPath == self.Chroot {
+		return "/", true
+	}
+	if strings.HasPrefix(serverPath, self.Chroot+"/") {
+		return strings.TrimPrefix(serverPath, self.Chroot), true
+	}
+	return "", false
+}
+
+func (self *ZkData) isRoot(nodePath string) bool {
+	for _, root := range self.Roots {
+		if root == nodePath {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteOldData removes nodePath and its whole subtree.
+func (self Snapshot) deleteOldData(nodePath string) {
+	node, ok := self[nodePath]
+	if !ok {
+		return
+	}
+	for _, childName := range node.Childs {
+		childPath := path.Join(nodePath, childName)
+		self.deleteOldData(childPath)
+	}
+	delete(self, nodePath)
+}
+
+// removeNode drops the subtree of a deleted node, including its entry in the
+// parent's children, so that templates never see a dangling child name.
+func (self Snapshot) removeNode(nodePath string) {
+	self.deleteOldData(nodePath)
+	parentPath := path.Dir(nodePath)
+	parent, ok := self[parentPath]
+	if !ok || parentPath == nodePath {
+		return
+	}
+	name := path.Base(nodePath)
+	childs := make([]string, 0, len(parent.Childs))
+	for _, childName := range parent.Childs {
+		if childName != name {
+			childs = append(childs, childName)
+		}
+	}
+	parent.Childs = childs
+	self[parentPath] = parent
+}
+
+// NewZkData returns an empty ZkData of roots. Nothing is fetched until
+// GetNodesW.
+func NewZkData(roots []string, conn *zk.Conn) *ZkData {
+	return &ZkData{
+		Conn:     conn,
+		Roots:    roots,
+		snapshot: make(Snapshot),
+	}
+}
+
+func CreateZkData(paths []string, conn *zk.Conn) (zkData *ZkData, err error) {
+	zkData = NewZkData(paths, conn)
+	err = zkData.watchRoots()
+	return zkData, err
+}
+
+// watchRoots fetches and watches the roots for the first time.
+func (self *ZkData) watchRoots() error {
+	if err := self.GetNodesW(self.Roots); err != nil {
+		return fmt.Errorf("Watch nodes failed, cause by: %+v", err)
+	}
+	return nil
+}
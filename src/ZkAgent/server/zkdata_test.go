@@ -0,0 +1,48 @@
+package ZkAgent
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSnapshotRemoveNode(t *testing.T) {
+	tests := []struct {
+		path   string
+		paths  []string
+		childs []string
+	}{
+		{path: "/app/a", paths: []string{"/app", "/app/b", "/other"}, childs: []string{"b"}},
+		{path: "/app", paths: []string{"/other"}},
+		{path: "/missing", paths: []string{"/app", "/app/a", "/app/b", "/other"}, childs: []string{"a", "b"}},
+	}
+	for _, test := range tests {
+		data := testSnapshot()
+		data.removeNode(test.path)
+		var paths []string
+		for nodePath := range data {
+			paths = append(paths, nodePath)
+		}
+		sort.Strings(paths)
+		if !reflect.DeepEqual(paths, test.paths) {
+			t.Errorf("%s: left %v, want %v", test.path, paths, test.paths)
+		}
+		if app, ok := data["/app"]; ok && !reflect.DeepEqual(app.Childs, test.childs) {
+			t.Errorf("%s: /app has %v, want %v", test.path, app.Childs, test.childs)
+		}
+	}
+}
+
+func TestSnapshotDeleteOldData(t *testing.T) {
+	data := testSnapshot()
+	data.deleteOldData("/app")
+	if len(data) != 1 {
+		t.Errorf("left %v, want /other only", data)
+	}
+	data = testSnapshot()
+	data.deleteOldData("/app/b")
+	// unlike removeNode, the parent still lists the child
+	if _, ok := data["/app/b"]; ok || len(data["/app"].Childs) != 2 {
+		t.Errorf("left %v", data)
+	}
+}